@@ -0,0 +1,126 @@
+// Copyright 2022 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package builder
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/u-root/u-root/pkg/cpio"
+)
+
+// Conflict policies for merging with a base initramfs.
+// They decide who wins when the sourcery tree and the base
+// both have a non-directory entry with the same name.
+const (
+	conflictSourcery = "sourcery"
+	conflictBase     = "base"
+	conflictError    = "error"
+)
+
+// readBase reads all the records of the initramfs in file.
+// The newc reader needs an io.ReaderAt, so the (possibly
+// decompressed) archive is held in memory.
+func readBase(file string) ([]cpio.Record, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := decompress(f)
+	if err != nil {
+		return nil, fmt.Errorf("%q: %v", file, err)
+	}
+	dat, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("%q: %v", file, err)
+	}
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		return nil, err
+	}
+	recs, err := cpio.ReadAllRecords(cpio.EOFReader{RecordReader: archiver.Reader(bytes.NewReader(dat))})
+	if err != nil {
+		return nil, fmt.Errorf("%q: %v", file, err)
+	}
+	return recs, nil
+}
+
+func isDir(r cpio.Record) bool {
+	return r.Mode&cpio.S_IFMT == cpio.S_IFDIR
+}
+
+// merge merges the sourcery records in tree on top of the records in base.
+// The base /init, if any, is renamed to /inito, and /init is then
+// pointed at the sourcery init in bin. Directories present in both
+// are merged; for anything else, policy decides who wins.
+// Base records are renumbered so their inodes do not collide with
+// those of the tree, which the kernel would take for hard links.
+func merge(base, tree []cpio.Record, bin, policy string) ([]cpio.Record, error) {
+	switch policy {
+	case conflictSourcery, conflictBase, conflictError:
+	default:
+		return nil, fmt.Errorf("unknown conflict policy %q: want %q, %q or %q", policy, conflictSourcery, conflictBase, conflictError)
+	}
+
+	var ino uint64
+	inTree := map[string]int{}
+	for i, r := range tree {
+		inTree[cpio.Normalize(r.Name)] = i
+		if r.Ino > ino {
+			ino = r.Ino
+		}
+	}
+
+	var (
+		recs    []cpio.Record
+		skip    = map[int]bool{}
+		inodes  = map[uint64]uint64{}
+		renamed bool
+	)
+	for _, r := range base {
+		r.Name = cpio.Normalize(r.Name)
+		if r.Name == "init" {
+			V("base: rename init to inito")
+			r.Name, renamed = "inito", true
+		}
+		if n, ok := inodes[r.Ino]; ok && r.NLink > 1 {
+			r.Ino = n
+		} else {
+			ino++
+			inodes[r.Ino], r.Ino = ino, ino
+		}
+		i, ok := inTree[r.Name]
+		if !ok {
+			recs = append(recs, r)
+			continue
+		}
+		if isDir(r) && isDir(tree[i]) {
+			continue
+		}
+		switch policy {
+		case conflictSourcery:
+			V("base: %q replaced by sourcery", r.Name)
+		case conflictBase:
+			V("base: %q kept from base", r.Name)
+			skip[i] = true
+			recs = append(recs, r)
+		case conflictError:
+			return nil, fmt.Errorf("%q is in both the base and the sourcery tree", r.Name)
+		}
+	}
+	for i, r := range tree {
+		if !skip[i] {
+			recs = append(recs, r)
+		}
+	}
+	if _, ok := inTree["init"]; renamed && !ok {
+		recs = append(recs, cpio.Symlink("init", "/"+filepath.Join(bin, "init")))
+	}
+	return recs, nil
+}
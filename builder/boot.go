@@ -0,0 +1,241 @@
+// Copyright 2022 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package builder
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// A stick boots many architectures in many ways. x86 needs
+// syslinux (installed into the stick with syslinux --install, which
+// we can not do for you) and reads boot/syslinux/syslinux.cfg.
+// U-Boot on ARM and RISC-V reads boot/extlinux/extlinux.conf.
+// EFI firmware on any of them runs EFI/BOOT/BOOT$ARCH.EFI. Given a
+// boot manager that reads the Boot Loader Specification entries in
+// loader/entries, such as systemd-boot, that is the boot manager.
+// Otherwise it is a copy of the kernel's EFI stub, which starts with no
+// command line, so the kernel must have the root and init it needs
+// built in, with CONFIG_CMDLINE; startup.nsh only helps from an EFI
+// shell. Every configuration boots the kernel with the vfat root and
+// the sourcery init for its own architecture.
+//
+// Kernels and EFI binaries are only of use on the stick, so they are
+// kept out of the cpio.
+
+// efiNames maps GOARCH to the names EFI uses for it.
+var efiNames = map[string]string{
+	"amd64":   "x64",
+	"386":     "ia32",
+	"arm64":   "aa64",
+	"arm":     "arm",
+	"riscv64": "riscv64",
+}
+
+func isX86(arch string) bool {
+	return arch == "amd64" || arch == "386"
+}
+
+// bootKernel is a kernel to boot an architecture.
+type bootKernel struct {
+	OS      string
+	Arch    string
+	Host    string // path on the build machine
+	Path    string // path in the tree, with leading /
+	Init    string
+	Cmdline string
+	Manager string // EFI boot manager on the build machine, if any
+}
+
+// Label returns the boot menu label for k.
+func (k bootKernel) Label() string {
+	return "sourcery-" + k.OS + "_" + k.Arch
+}
+
+// parseKernels parses arch=path kernel specs for kern.
+// root and extra are used to build each kernel's command line.
+func parseKernels(specs []string, kern, root, extra string) ([]bootKernel, error) {
+	var ks []bootKernel
+	seen := map[string]bool{}
+	for _, s := range specs {
+		a, p, ok := strings.Cut(s, "=")
+		if !ok {
+			return nil, fmt.Errorf("kernel %q: want arch=path", s)
+		}
+		if _, ok := efiNames[a]; !ok {
+			return nil, fmt.Errorf("kernel %q: unsupported arch %q", s, a)
+		}
+		if seen[a] {
+			return nil, fmt.Errorf("kernel %q: more than one kernel for %q", s, a)
+		}
+		seen[a] = true
+		k := bootKernel{
+			OS:   kern,
+			Arch: a,
+			Host: p,
+			Path: fmt.Sprintf("/boot/%s_%s/%s", kern, a, filepath.Base(p)),
+			Init: fmt.Sprintf("/%s_%s/bin/init", kern, a),
+		}
+		k.Cmdline = strings.TrimSpace(fmt.Sprintf("root=%s rootfstype=vfat rootwait rw init=%s %s", root, k.Init, extra))
+		ks = append(ks, k)
+	}
+	return ks, nil
+}
+
+// parseManagers parses arch=path EFI boot manager specs.
+func parseManagers(specs []string) (map[string]string, error) {
+	m := map[string]string{}
+	for _, s := range specs {
+		a, p, ok := strings.Cut(s, "=")
+		if !ok {
+			return nil, fmt.Errorf("EFI boot manager %q: want arch=path", s)
+		}
+		if _, ok := efiNames[a]; !ok {
+			return nil, fmt.Errorf("EFI boot manager %q: unsupported arch %q", s, a)
+		}
+		m[a] = p
+	}
+	return m, nil
+}
+
+// kernels returns the kernels to boot, with their boot managers.
+func (b *Builder) kernels() ([]bootKernel, error) {
+	ks, err := parseKernels(b.Kernels, b.OS, b.kernelRoot(), b.Cmdline)
+	if err != nil {
+		return nil, err
+	}
+	m, err := parseManagers(b.EFIBoot)
+	if err != nil {
+		return nil, err
+	}
+	for i := range ks {
+		ks[i].Manager = m[ks[i].Arch]
+		delete(m, ks[i].Arch)
+	}
+	for a := range m {
+		return nil, fmt.Errorf("EFI boot manager for %q, but no kernel", a)
+	}
+	return ks, nil
+}
+
+// diskID returns a disk identifier derived from seed. Deriving it,
+// rather than picking one at random, keeps images reproducible.
+func diskID(seed string) uint32 {
+	h := sha256.Sum256([]byte(seed))
+	return binary.LittleEndian.Uint32(h[:])
+}
+
+// bootRoot returns the root= value for a stick with partition table part
+// and disk identifier id.
+func bootRoot(part string, id uint32) string {
+	if u := partUUID(part, id); u != "" {
+		return "PARTUUID=" + u
+	}
+	return "/dev/sda"
+}
+
+var (
+	syslinuxCfg = template.Must(template.New("syslinux").Parse(`DEFAULT {{ (index . 0).Label }}
+PROMPT 1
+TIMEOUT 50
+{{ range . }}
+LABEL {{ .Label }}
+	KERNEL {{ .Path }}
+	APPEND {{ .Cmdline }}
+{{ end }}`))
+
+	extlinuxConf = template.Must(template.New("extlinux").Parse(`default {{ (index . 0).Label }}
+menu title sourcery
+timeout 50
+{{ range . }}
+label {{ .Label }}
+	linux {{ .Path }}
+	append {{ .Cmdline }}
+{{ end }}`))
+
+	blsEntry = template.Must(template.New("bls").Parse(`title sourcery {{ .Arch }}
+linux {{ .Path }}
+options {{ .Cmdline }}
+architecture {{ .EFI }}
+`))
+)
+
+// loaderConf is the boot manager's configuration. Entries for other
+// architectures are not shown, so the default is any sourcery entry.
+const loaderConf = "default sourcery-*\ntimeout 5\n"
+
+// bootFiles adds the kernels in ks, and configurations to boot them,
+// to the image. It returns the paths in the image of the kernels and
+// EFI binaries.
+func bootFiles(img *overlay, ks []bootKernel) ([]string, error) {
+	write := func(n string, dat []byte, mode os.FileMode) {
+		V("boot: write %q", n)
+		img.WriteFile(strings.TrimPrefix(n, "/"), dat, mode)
+	}
+	expand := func(t *template.Template, v interface{}) []byte {
+		var b bytes.Buffer
+		if err := t.Execute(&b, v); err != nil {
+			// The templates are fixed, so this is a bug.
+			panic(err)
+		}
+		return b.Bytes()
+	}
+
+	var x86, other []bootKernel
+	var managed bool
+	var nsh bytes.Buffer
+	var bins []string
+	for _, k := range ks {
+		if _, err := os.Stat(k.Host); err != nil {
+			return nil, err
+		}
+		efi := efiNames[k.Arch]
+		kernel, boot := strings.TrimPrefix(k.Path, "/"), path.Join("EFI/BOOT", "BOOT"+strings.ToUpper(efi)+".EFI")
+		img.CopyFile(kernel, k.Host, 0644)
+		if k.Manager != "" {
+			if _, err := os.Stat(k.Manager); err != nil {
+				return nil, err
+			}
+			img.CopyFile(boot, k.Manager, 0644)
+			managed = true
+		} else {
+			img.CopyFile(boot, k.Host, 0644)
+		}
+		bins = append(bins, kernel, boot)
+		entry := expand(blsEntry, struct {
+			bootKernel
+			EFI string
+		}{k, efi})
+		write(path.Join("loader/entries", k.Label()+".conf"), entry, 0644)
+		// The EFI shell runs startup.nsh; only the line for the
+		// running architecture can work.
+		fmt.Fprintf(&nsh, "%s %s\r\n", strings.ReplaceAll(k.Path, "/", `\`), k.Cmdline)
+		if isX86(k.Arch) {
+			x86 = append(x86, k)
+		} else {
+			other = append(other, k)
+		}
+	}
+	if len(ks) > 0 {
+		write("startup.nsh", nsh.Bytes(), 0644)
+	}
+	if managed {
+		write("loader/loader.conf", []byte(loaderConf), 0644)
+	}
+	if len(x86) > 0 {
+		write("boot/syslinux/syslinux.cfg", expand(syslinuxCfg, x86), 0644)
+	}
+	if len(other) > 0 {
+		write("boot/extlinux/extlinux.conf", expand(extlinuxConf, other), 0644)
+	}
+	return bins, nil
+}
@@ -0,0 +1,82 @@
+// Copyright 2022 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package builder
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/cpio"
+)
+
+func TestBoot(t *testing.T) {
+	d := t.TempDir()
+	for _, n := range []string{"bzImage", "Image", "systemd-bootx64.efi"} {
+		if err := os.WriteFile(filepath.Join(d, n), []byte(n), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := New(Options{
+		OS:        "linux",
+		Arch:      "amd64",
+		Workspace: t.TempDir(),
+		CPIO:      filepath.Join(t.TempDir(), "cpio"),
+		Compress:  "none",
+		Kernels:   []string{"amd64=" + filepath.Join(d, "bzImage"), "arm64=" + filepath.Join(d, "Image")},
+		EFIBoot:   []string{"amd64=" + filepath.Join(d, "systemd-bootx64.efi")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := b.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Boot(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for n, want := range map[string]string{
+		"EFI/BOOT/BOOTX64.EFI":     "systemd-bootx64.efi",
+		"EFI/BOOT/BOOTAA64.EFI":    "Image",
+		"boot/linux_amd64/bzImage": "bzImage",
+		"loader/loader.conf":       loaderConf,
+	} {
+		if got, err := fs.ReadFile(b.img, n); err != nil || string(got) != want {
+			t.Errorf("%q: got %q, %v, want %q, nil", n, got, err, want)
+		}
+	}
+	if err := b.ramfs(b.img, b.CPIO); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(b.CPIO)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	recs, err := cpio.ReadAllRecords(cpio.Newc.Reader(f))
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := map[string]bool{}
+	for _, r := range recs {
+		in[r.Name] = true
+	}
+	for _, n := range []string{"EFI/BOOT/BOOTX64.EFI", "boot/linux_amd64/bzImage", "boot/linux_arm64/Image"} {
+		if in[n] {
+			t.Errorf("cpio: got %q, want it left out", n)
+		}
+	}
+	if !in["loader/entries/sourcery-linux_amd64.conf"] {
+		t.Errorf("cpio: no loader/entries/sourcery-linux_amd64.conf")
+	}
+
+	b.EFIBoot = []string{"riscv64=" + filepath.Join(d, "systemd-bootx64.efi")}
+	if _, err := b.kernels(); err == nil {
+		t.Errorf("kernels with a boot manager for riscv64 and no kernel: got nil, want error")
+	}
+}
@@ -0,0 +1,587 @@
+// Copyright 2022 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package builder builds sourcery images: a Go toolchain, the sources
+// of the repos you name, and a stub for each command that compiles it
+// on first use, written as a tree, cpio, FAT32, ISO or OCI image.
+//
+// Build does everything; the phases it is made of, Toolchain, Get,
+// Stubs, Tools, Boot and Archive, may also be run one at a time, in
+// that order, after Start.
+package builder
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/u-root/sourcery/manifest"
+)
+
+// V logs what the builder does. Set it to silence or redirect it.
+var V = log.Printf
+
+// SelfRepo is where sourcery itself is fetched from, to build init and
+// installcommand in the image.
+const SelfRepo = "git@github.com:u-root/sourcery"
+
+// buildTools are built when the image is, not on first use.
+var buildTools = []string{"installcommand", "init"}
+
+// Options describe a build. The zero value of each is a reasonable
+// default, except that a build with no outputs writes its tree into the
+// workspace.
+type Options struct {
+	// Version is the Go toolchain to build with. Default go1.17.7.
+	Version string
+	// OS and Arch are the target. Default runtime.GOOS and runtime.GOARCH.
+	OS, Arch string
+	// Workspace is where the toolchain and sources are kept. If it
+	// is empty, Start makes a temporary directory. Building into an
+	// existing workspace only redoes what changed.
+	Workspace string
+	// Repos are the git repos, e.g. git@github.com:u-root/u-root,
+	// whose commands go in the image.
+	Repos []string
+	// Modules are commands named by package path and version, e.g.
+	// golang.org/x/tools/cmd/stringer@v0.1.12, to download through
+	// GOPROXY rather than clone.
+	Modules []string
+	// GOPROXY is the proxy to download modules through, e.g.
+	// file:///srv/goproxy. Default is $GOPROXY.
+	GOPROXY string
+	// Rewrites are from=to rules, like git's insteadOf, to fetch
+	// repos, the Go toolchain and sourcery itself from mirrors: URLs
+	// starting with from are fetched from to instead.
+	Rewrites []string
+	// Pins are the commits to build repos at, by URL, instead of the
+	// tip of their default branch.
+	Pins map[string]string
+	// Patches are, for each repo, patch files, or directories of
+	// .patch and .diff files, to apply to it when it is fetched.
+	Patches map[string][]string
+	// ToolSource is the directory with the init and installcommand
+	// sources. Default is the sourcery repo in the workspace.
+	ToolSource string
+	// Resume continues the last build in Workspace from the first
+	// phase that did not finish.
+	Resume bool
+	// Report, if set, is a file for a JSON build report.
+	Report string
+	// SourceDateEpoch, if not zero, is the modification time of the
+	// files sourcery generates, and the latest of any file, as
+	// SOURCE_DATE_EPOCH is for reproducible builds.
+	SourceDateEpoch time.Time
+
+	// CPIO is the cpio output.
+	CPIO string
+	// Base is a cpio, possibly compressed, to merge the tree on top
+	// of; its /init becomes /inito. Conflict is who wins when both
+	// have a file: sourcery (the default), base, or error.
+	Base, Conflict string
+	// Compress is the cpio compression: none, gzip or xz. Default
+	// none, or gzip with Early.
+	Compress string
+	// Early are host[:dest] files or directories for an uncompressed
+	// cpio ahead of the main one, for microcode and firmware.
+	Early []string
+
+	// VFAT is the FAT32 disk image output. VFATSize is its size in
+	// bytes; default is to fit the tree. VFATPart is its partition
+	// table: none, mbr (the default) or gpt.
+	VFAT     string
+	VFATSize int64
+	VFATPart string
+	// Kernels are arch=path kernels to boot from the image.
+	Kernels []string
+	// EFIBoot are arch=path EFI boot managers, e.g. systemd-boot, to
+	// boot the kernels for arch with. Without one, EFI boots the
+	// kernel itself, which must have its command line built in.
+	EFIBoot []string
+	// Root is root= for the kernels; default is the PARTUUID of the
+	// VFAT image, or /dev/sda1. Cmdline is added to each command line.
+	Root, Cmdline string
+
+	// ISO is the ISO 9660 image output. ISOBIOS and ISOEFI are paths
+	// in the tree of El Torito boot images; ISOMBR is a file of MBR
+	// boot code, for a hybrid image.
+	ISO, ISOBIOS, ISOEFI, ISOMBR string
+
+	// OCI is the OCI image layout output. If OCISplit, the toolchain,
+	// sources and the rest are separate layers.
+	OCI      string
+	OCISplit bool
+
+	// Tree is a directory to write the tree into.
+	Tree string
+	// SBOM is a directory to write an SPDX SBOM and the license
+	// files of everything in the image to. They go in the image, in
+	// /share/sbom, too.
+	SBOM string
+	// SignKey is a PEM ed25519 private key file to sign a manifest
+	// of the image's files with. init checks it at boot.
+	SignKey string
+	// VerifyPolicy is what init does if files do not match the
+	// manifest: enforce, refusing to boot, the default, or warn.
+	VerifyPolicy string
+	// SourcePolicy is what installcommand does if the sources of a
+	// command do not match the manifest: enforce, refusing to build
+	// it, the default, or warn. It is in the image, in
+	// /etc/sourcery/source-policy, to be changed at run time.
+	SourcePolicy string
+	// Overlays are dir[:dest] directories to copy into the image at
+	// dest, default /, keeping their modes. Their files win over
+	// those sourcery generates.
+	Overlays []string
+	// Files are host[:dest] files or directories to copy into the
+	// image at dest, default their host path. Dynamically linked ELF
+	// binaries get their shared libraries, too: from Sysroot, a root
+	// filesystem for the target, if set, or else from the host, which
+	// must then be the target.
+	Files   []string
+	Sysroot string
+	// KernelModules is a kernel's modules directory, e.g.
+	// /lib/modules/6.1.0-13-amd64. The modules named in KModules,
+	// and those for the modaliases in the Hardware file, one per
+	// line, go in /$OS_$ARCH/lib/modules with the modules they
+	// depend on, for init to load. The firmware they name is copied
+	// from the Firmware directory to /lib/firmware.
+	KernelModules string
+	KModules      []string
+	Hardware      string
+	Firmware      string
+	// Prebuild are commands, by name, to compile into the bin
+	// directory with the tools, rather than on first use.
+	Prebuild []string
+
+	// Hooks run at points in the build.
+	Hooks []Hook
+}
+
+// Builder builds one image.
+type Builder struct {
+	Options
+	bin string // the bin directory in the image, e.g. linux_amd64/bin
+	st  *state
+	img *overlay
+	id  uint32
+
+	signKey ed25519.PrivateKey
+	// bootOnly are the kernels and EFI binaries, kept out of the cpio.
+	bootOnly map[string]bool
+
+	// Chroot is a command to try the tree, once it has been written.
+	Chroot string
+}
+
+// New returns a Builder for o.
+func New(o Options) (*Builder, error) {
+	if o.Version == "" {
+		o.Version = "go1.17.7"
+	}
+	if o.OS == "" {
+		o.OS = runtime.GOOS
+	}
+	if o.Arch == "" {
+		o.Arch = runtime.GOARCH
+	}
+	if o.Conflict == "" {
+		o.Conflict = conflictSourcery
+	}
+	if o.VFATPart == "" {
+		o.VFATPart = partMBR
+	}
+	if o.VerifyPolicy == "" {
+		o.VerifyPolicy = manifest.Enforce
+	}
+	if o.SourcePolicy == "" {
+		o.SourcePolicy = manifest.Enforce
+	}
+	switch {
+	case o.Base != "" && o.CPIO == "":
+		return nil, fmt.Errorf("a base cpio requires a cpio output")
+	case len(o.Early) > 0 && o.CPIO == "":
+		return nil, fmt.Errorf("an early cpio requires a cpio output")
+	case o.Resume && o.Workspace == "":
+		return nil, fmt.Errorf("resuming requires a workspace")
+	case (len(o.KModules) > 0 || o.Hardware != "" || o.Firmware != "") && o.KernelModules == "":
+		return nil, fmt.Errorf("kernel modules and firmware require a kernel modules directory")
+	}
+	if err := checkModules(o.Modules); err != nil {
+		return nil, err
+	}
+	if err := checkPrebuild(o.Prebuild); err != nil {
+		return nil, err
+	}
+	if err := checkFiles(o.Files); err != nil {
+		return nil, err
+	}
+	if err := checkRewrites(o.Rewrites); err != nil {
+		return nil, err
+	}
+	if _, err := parseManagers(o.EFIBoot); err != nil {
+		return nil, err
+	}
+	if err := checkHooks(o.Hooks); err != nil {
+		return nil, err
+	}
+	hooks, err := absHooks(o.Hooks)
+	if err != nil {
+		return nil, err
+	}
+	o.Hooks = hooks
+	for r := range o.Patches {
+		if _, err := patchFiles(o.Patches[r]); err != nil {
+			return nil, fmt.Errorf("patches for %q: %v", r, err)
+		}
+	}
+	for _, p := range []string{o.VerifyPolicy, o.SourcePolicy} {
+		if err := manifest.CheckPolicy(p); err != nil {
+			return nil, err
+		}
+	}
+	b := &Builder{Options: o, bin: path.Join(fmt.Sprintf("%v_%v", o.OS, o.Arch), "bin")}
+	b.id = diskID(strings.Join(b.args(), " "))
+	if o.SignKey != "" {
+		k, err := loadSignKey(o.SignKey)
+		if err != nil {
+			return nil, fmt.Errorf("sign key: %v", err)
+		}
+		b.signKey = k
+	}
+	return b, nil
+}
+
+// args returns what identifies the build.
+func (b *Builder) args() []string {
+	return append([]string{b.Version, b.OS, b.Arch}, b.Repos...)
+}
+
+// repos returns the repos to fetch: those asked for, and sourcery.
+func (b *Builder) repos() []string {
+	return append(append([]string{}, b.Repos...), SelfRepo)
+}
+
+// Bin returns the bin directory in the image, e.g. linux_amd64/bin.
+func (b *Builder) Bin() string {
+	return b.bin
+}
+
+// Start makes the workspace, if need be, and the image.
+func (b *Builder) Start(ctx context.Context) error {
+	V("Building for %v_%v", b.OS, b.Arch)
+	if b.Workspace == "" {
+		d, err := os.MkdirTemp("", "sourcery")
+		if err != nil {
+			return err
+		}
+		b.Workspace = d
+	}
+	if b.ToolSource == "" {
+		host, dir, base, err := goName(SelfRepo)
+		if err != nil {
+			return err
+		}
+		b.ToolSource = filepath.Join(b.Workspace, "src", host, dir, base)
+	}
+	st, err := loadState(b.Workspace)
+	if err != nil {
+		return err
+	}
+	b.st = st
+	if err := st.start(b.args(), b.Resume); err != nil {
+		return err
+	}
+	if b.Report != "" {
+		st.rep = newReport(b.Report, b.Workspace, b.Version, b.OS, b.Arch, b.Repos)
+	}
+	b.img = newOverlay(b.Workspace, b.SourceDateEpoch)
+	tree(b.img)
+	b.etc()
+	if err := b.addFiles(); err != nil {
+		return err
+	}
+	for _, o := range b.Overlays {
+		dir, dest := splitOverlay(o)
+		if err := b.img.AddDir(dir, dest); err != nil {
+			return fmt.Errorf("overlay %q: %v", o, err)
+		}
+	}
+	return os.MkdirAll(filepath.Join(b.Workspace, b.bin), 0755)
+}
+
+// Toolchain fetches and builds the Go toolchain.
+func (b *Builder) Toolchain(ctx context.Context) error {
+	d := b.Workspace
+	if err := b.phase(ctx, "toolchain", "", func() error {
+		if err := getgo(ctx, d, b.Version, b.rewrite(goRepo)); err != nil {
+			log.Printf("getgo errored, %v, keep going", err)
+		}
+		if b.st.fresh("toolchain", b.toolchainKey(ctx)) {
+			return nil
+		}
+		if err := b.buildToolchain(ctx); err != nil {
+			return err
+		}
+		return b.st.stamp("toolchain", b.toolchainKey(ctx))
+	}); err != nil {
+		return err
+	}
+	b.st.rep.measure("toolchain", filepath.Join(d, "go"))
+	return nil
+}
+
+// Get fetches the repos, and sourcery itself, into the workspace, and
+// downloads the modules.
+func (b *Builder) Get(ctx context.Context) error {
+	src := filepath.Join(b.Workspace, "src")
+	if err := os.MkdirAll(src, 0755); err != nil {
+		return err
+	}
+	if err := b.get(ctx, src, b.repos()...); err != nil {
+		return fmt.Errorf("Getting packages: %v", err)
+	}
+	if err := b.modules(ctx); err != nil {
+		return fmt.Errorf("Getting modules: %v", err)
+	}
+	return nil
+}
+
+// Stubs adds a stub for each command in the repos to the image.
+func (b *Builder) Stubs(ctx context.Context) error {
+	return b.phase(ctx, "stubs", "", func() error {
+		if err := files(b.Workspace, b.bin, b.img, b.prebuilt()); err != nil {
+			return err
+		}
+		return b.moduleStubs(ctx)
+	})
+}
+
+// toolSources returns the files of the packages in ToolSource's module
+// that tool imports, itself included, so that a change to any of them,
+// e.g. to manifest, rebuilds it.
+func (b *Builder) toolSources(ctx context.Context, tool string) ([]string, error) {
+	var out bytes.Buffer
+	c := exec.CommandContext(ctx, filepath.Join(b.Workspace, "go/bin/go"), "list", "-deps", "-f",
+		"{{if .Module}}{{if .Module.Main}}{{range .GoFiles}}{{$.Dir}}/{{.}}\n{{end}}{{range .EmbedFiles}}{{$.Dir}}/{{.}}\n{{end}}{{end}}{{end}}")
+	c.Dir = filepath.Join(b.ToolSource, tool)
+	c.Stdout, c.Stderr = &out, os.Stderr
+	c.Env = append(os.Environ(), b.goPathEnv()...)
+	c.Env = append(c.Env, b.goEnv()...)
+	if err := c.Run(); err != nil {
+		return nil, fmt.Errorf("go list: %v", err)
+	}
+	return strings.Fields(out.String()), nil
+}
+
+// Tools builds init and installcommand, and the prebuilt commands, into
+// the image.
+func (b *Builder) Tools(ctx context.Context) error {
+	d := b.Workspace
+	V("Build tools from %q", b.ToolSource)
+	for _, tool := range buildTools {
+		// The tool, not its stub.
+		b.img.Remove(path.Join(b.bin, tool))
+	}
+	if err := b.phase(ctx, "tools", "", func() error {
+		for _, tool := range buildTools {
+			goBin := filepath.Join(d, b.bin, tool)
+			srcs, err := b.toolSources(ctx, tool)
+			if err != nil {
+				return fmt.Errorf("%q: %v", tool, err)
+			}
+			key, err := srcKey(append(srcs, filepath.Join(b.ToolSource, "go.mod"), filepath.Join(b.ToolSource, "go.sum"))...)
+			if err != nil {
+				return err
+			}
+			key = b.toolchainKey(ctx) + " " + key + " " + strings.Join(b.toolFlags(), " ")
+			if _, err := os.Stat(goBin); err == nil && b.st.fresh(tool, key) {
+				continue
+			}
+			V("Build %q in %q, install to %q", tool, b.ToolSource, goBin)
+			if err := b.build(ctx, b.ToolSource, tool, goBin, b.toolFlags()...); err != nil {
+				return fmt.Errorf("Building %q -> %q: %v", goBin, tool, err)
+			}
+			if err := b.st.stamp(tool, key); err != nil {
+				return err
+			}
+		}
+		return b.prebuild(ctx)
+	}); err != nil {
+		return err
+	}
+	var bins []string
+	for _, tool := range append(append([]string{}, buildTools...), b.Prebuild...) {
+		bins = append(bins, filepath.Join(d, b.bin, tool))
+	}
+	b.st.rep.measure("tools", bins...)
+	return nil
+}
+
+// Boot adds the kernels, and configurations to boot them, and the
+// kernel modules and firmware to the image.
+func (b *Builder) Boot(ctx context.Context) error {
+	return b.phase(ctx, "boot", "", func() error {
+		if err := b.kmods(); err != nil {
+			return fmt.Errorf("kernel modules: %v", err)
+		}
+		if len(b.Kernels) == 0 {
+			return nil
+		}
+		ks, err := b.kernels()
+		if err != nil {
+			return err
+		}
+		bins, err := bootFiles(b.img, ks)
+		if err != nil {
+			return fmt.Errorf("boot files: %v", err)
+		}
+		b.bootOnly = map[string]bool{}
+		for _, n := range bins {
+			b.bootOnly[n] = true
+		}
+		return nil
+	})
+}
+
+// Archive writes the outputs.
+func (b *Builder) Archive(ctx context.Context) error {
+	t := b.TreeDir()
+	if err := b.phase(ctx, "archive", "", func() error {
+		if b.SBOM != "" {
+			if err := b.sbom(ctx); err != nil {
+				return fmt.Errorf("sbom: %v", err)
+			}
+		}
+		// The manifest goes last, to cover everything else.
+		if b.signKey != nil {
+			if err := b.sign(); err != nil {
+				return fmt.Errorf("sign: %v", err)
+			}
+		}
+		if b.CPIO != "" {
+			if err := b.ramfs(b.img, b.CPIO); err != nil {
+				return fmt.Errorf("ramfs: %v", err)
+			}
+		}
+		if b.VFAT != "" {
+			if err := vfat(b.img, b.VFAT, b.VFATSize, b.VFATPart, b.id); err != nil {
+				return fmt.Errorf("vfat: %v", err)
+			}
+			log.Printf("dd if=%q of=/dev/your-usb-stick bs=1M conv=fsync", b.VFAT)
+		}
+		if b.ISO != "" {
+			opt := isoOptions{BIOS: b.ISOBIOS, EFI: b.ISOEFI}
+			if b.ISOMBR != "" {
+				var err error
+				if opt.MBR, err = os.ReadFile(b.ISOMBR); err != nil {
+					return err
+				}
+			}
+			if err := iso(b.img, b.ISO, opt); err != nil {
+				return fmt.Errorf("iso: %v", err)
+			}
+		}
+		if b.OCI != "" {
+			if err := oci(b.img, b.OCI, b.OS, b.Arch, b.OCISplit); err != nil {
+				return fmt.Errorf("oci: %v", err)
+			}
+			log.Printf("podman run --privileged -it oci:%s:latest", b.OCI)
+		}
+
+		switch t {
+		case "":
+		case b.Workspace:
+			if err := b.img.materialize(b.Workspace); err != nil {
+				return fmt.Errorf("tree: %v", err)
+			}
+		default:
+			if err := writeTree(b.img, t); err != nil {
+				return fmt.Errorf("tree: %v", err)
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	var paths []string
+	for _, o := range []reportOutput{{"cpio", b.CPIO, 0}, {"vfat", b.VFAT, 0}, {"iso", b.ISO, 0}, {"oci", b.OCI, 0}, {"sbom", b.SBOM, 0}, {"tree", t, 0}} {
+		b.st.rep.output(o.Kind, o.Path)
+		if o.Path != "" && o.Path != b.Workspace {
+			paths = append(paths, o.Path)
+		}
+	}
+	b.st.rep.measure("archive", paths...)
+	if t != "" {
+		b.Chroot = fmt.Sprintf("unshare -m chroot %q /%q_%q/bin/init", t, b.OS, b.Arch)
+	}
+	return nil
+}
+
+// Build does the whole build.
+func (b *Builder) Build(ctx context.Context) error {
+	if err := b.Start(ctx); err != nil {
+		return err
+	}
+	for _, f := range []func(context.Context) error{b.Toolchain, b.Get, b.Stubs, b.Tools, b.Boot, b.Archive} {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := f(ctx); err != nil {
+			return err
+		}
+	}
+	if b.st.rep != nil {
+		b.st.rep.Chroot = b.Chroot
+		b.st.rep.Result = "ok"
+		if err := b.st.rep.save(); err != nil {
+			return fmt.Errorf("report: %v", err)
+		}
+	}
+	return nil
+}
+
+// splitOverlay splits a dir[:dest] overlay into the directory and its
+// destination in the image.
+func splitOverlay(o string) (string, string) {
+	dir, dest, ok := strings.Cut(o, ":")
+	if !ok {
+		dest = "."
+	}
+	return dir, path.Clean(strings.TrimPrefix(dest, "/"))
+}
+
+// kernelRoot returns the root= for the kernels.
+func (b *Builder) kernelRoot() string {
+	switch {
+	case b.Root != "":
+		return b.Root
+	case b.VFAT != "":
+		return bootRoot(b.VFATPart, b.id)
+	}
+	return "/dev/sda1"
+}
+
+// noOutputs returns true if no output is named, in which case the
+// workspace becomes the tree, as it always has.
+func (b *Builder) noOutputs() bool {
+	return b.Tree == "" && b.CPIO == "" && b.VFAT == "" && b.ISO == "" && b.OCI == ""
+}
+
+// TreeDir returns where the tree is written, or "" if it is not.
+func (b *Builder) TreeDir() string {
+	if b.noOutputs() {
+		return b.Workspace
+	}
+	return b.Tree
+}
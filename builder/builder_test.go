@@ -0,0 +1,197 @@
+// Copyright 2022 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package builder
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	for _, o := range []Options{
+		{Base: "base.cpio"},
+		{Early: []string{"/lib/firmware/intel-ucode"}},
+		{Resume: true},
+		{VerifyPolicy: "shrug"},
+		{SignKey: "/no/such/key.pem"},
+		{Rewrites: []string{"git@github.com:"}},
+		{Modules: []string{"golang.org/x/tools/cmd/stringer"}},
+		{Prebuild: []string{"init"}},
+		{Prebuild: []string{"cmds/core/ls"}},
+	} {
+		if _, err := New(o); err == nil {
+			t.Errorf("New(%+v): got nil, want error", o)
+		}
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	b := &Builder{Options: Options{Rewrites: []string{
+		"git@github.com:=https://mirror.example.com/github/",
+		"git@github.com:golang/=file:///srv/golang/",
+	}}}
+	for u, want := range map[string]string{
+		"git@github.com:u-root/u-root": "https://mirror.example.com/github/u-root/u-root",
+		"git@github.com:golang/go":     "file:///srv/golang/go",
+		"https://gitlab.com/x/y":       "https://gitlab.com/x/y",
+	} {
+		if got := b.rewrite(u); got != want {
+			t.Errorf("rewrite(%q): got %q, want %q", u, got, want)
+		}
+	}
+}
+
+func TestModuleCommand(t *testing.T) {
+	for p, want := range map[string]string{
+		"golang.org/x/tools/cmd/stringer": "stringer",
+		"github.com/foo/bar/v2":           "bar",
+		"v2":                              "v2",
+	} {
+		if got := moduleCommand(p); got != want {
+			t.Errorf("moduleCommand(%q): got %q, want %q", p, got, want)
+		}
+	}
+}
+
+func TestToolSources(t *testing.T) {
+	src := t.TempDir()
+	for n, s := range map[string]string{
+		"go.mod":               "module example.com/tools\n\ngo 1.17\n",
+		"init/main.go":         "package main\n\nimport \"example.com/tools/manifest\"\n\nfunc main() { manifest.Check() }\n",
+		"manifest/manifest.go": "package manifest\n\nfunc Check() {}\n",
+		"other/other.go":       "package other\n",
+	} {
+		p := filepath.Join(src, n)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b := &Builder{Options: Options{Workspace: testWorkspace(t), ToolSource: src, OS: "linux", Arch: "amd64"}}
+	got, err := b.toolSources(context.Background(), "init")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got)
+	want := []string{filepath.Join(src, "init/main.go"), filepath.Join(src, "manifest/manifest.go")}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("toolSources(init): got %q, want %q", got, want)
+	}
+}
+
+// TestStubs runs the start and stubs phases of a build alone, with the
+// commands already in the workspace.
+func TestStubs(t *testing.T) {
+	d := t.TempDir()
+	for _, c := range []string{"core/ls", "core/cat", "exp/ed"} {
+		if err := os.MkdirAll(filepath.Join(d, "src/github.com/u-root/u-root/cmds", c), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := New(Options{OS: "linux", Arch: "arm64", Workspace: d, Tree: filepath.Join(t.TempDir(), "tree"), Prebuild: []string{"cat"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := b.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Stubs(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat(b.img, "linux_arm64/bin/cat"); err == nil {
+		t.Errorf("stub %q: prebuilt, but got one", "cat")
+	}
+	for _, c := range []string{"ls", "ed"} {
+		dat, err := fs.ReadFile(b.img, "linux_arm64/bin/"+c)
+		if err != nil {
+			t.Errorf("stub %q: %v", c, err)
+			continue
+		}
+		if len(dat) < 3 || string(dat[:3]) != "#!/" {
+			t.Errorf("stub %q: got %q, want #!/...", c, dat)
+		}
+	}
+	if dat, err := fs.ReadFile(b.img, "etc/os-release"); err != nil || !strings.Contains(string(dat), `SOURCERY_TARGET="linux_arm64"`) {
+		t.Errorf("etc/os-release: got %q, %v, want SOURCERY_TARGET=\"linux_arm64\"", dat, err)
+	}
+	p, err := b.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Stubs) != 2 {
+		t.Errorf("plan stubs: got %q, want 2 of them", p.Stubs)
+	}
+	if len(p.Tools) != len(buildTools)+1 {
+		t.Errorf("plan tools: got %q, want %d of them", p.Tools, len(buildTools)+1)
+	}
+}
+
+func TestHooks(t *testing.T) {
+	d := t.TempDir()
+	sd := t.TempDir()
+	script := filepath.Join(sd, "hook")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\necho $SOURCERY_POINT $SOURCERY_TARGET $1 >> \"$SOURCERY_WORKSPACE/hooked\"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	var points []string
+	f := func(ctx context.Context, h *HookContext) error {
+		points = append(points, h.Point)
+		h.WriteFile("etc/motd", []byte("hi\n"), 0644)
+		return nil
+	}
+	if _, err := New(Options{Hooks: []Hook{{Point: "during-stubs", Func: f}}}); err == nil {
+		t.Errorf("New with a hook at during-stubs: got nil, want error")
+	}
+	// Relative commands are from where New is called.
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(sd); err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(Options{OS: "linux", Arch: "arm64", Workspace: d, Hooks: []Hook{
+		{Point: "pre-stubs", Func: f},
+		{Point: "post-stubs", Command: script},
+		{Point: "pre-boot", Command: "./hook boot"},
+		{Point: "post-boot", Func: f},
+	}})
+	if err := os.Chdir(wd); err != nil {
+		t.Fatal(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := b.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Stubs(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Boot(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"pre-stubs", "post-boot"}; strings.Join(points, " ") != strings.Join(want, " ") {
+		t.Errorf("hooks ran at %q, want %q", points, want)
+	}
+	if _, err := fs.Stat(b.img, "etc/motd"); err != nil {
+		t.Errorf("file from hook: %v", err)
+	}
+	want := "post-stubs linux_arm64\npre-boot linux_arm64 boot\n"
+	dat, err := os.ReadFile(filepath.Join(d, "hooked"))
+	if err != nil || string(dat) != want {
+		t.Errorf("command hooks: got %q, %v, want %q, nil", dat, err, want)
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2022 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package builder
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/ulikunitz/xz"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	xzMagic   = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+)
+
+// decompress returns a reader for r, which may be gzip or xz
+// compressed, or not compressed at all.
+func decompress(r io.Reader) (io.Reader, error) {
+	b := bufio.NewReader(r)
+	magic, err := b.Peek(len(xzMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(b)
+	case bytes.HasPrefix(magic, xzMagic):
+		return xz.NewReader(b)
+	}
+	return b, nil
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// compressor returns a writer that compresses to w with method,
+// one of none, gzip or xz. Closing it flushes the compressor,
+// but does not close w.
+func compressor(w io.Writer, method string) (io.WriteCloser, error) {
+	switch method {
+	case "", "none":
+		return nopCloser{w}, nil
+	case "gzip":
+		return gzip.NewWriterLevel(w, gzip.BestCompression)
+	case "xz":
+		// The kernel xz decoder only does CRC32.
+		return xz.WriterConfig{CheckSum: xz.CRC32}.NewWriter(w)
+	}
+	return nil, fmt.Errorf("unknown compression %q: want none, gzip or xz", method)
+}
@@ -0,0 +1,180 @@
+// Copyright 2022 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package builder
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+
+	"github.com/u-root/u-root/pkg/cpio"
+)
+
+// linuxMode returns the Linux mode bits for m.
+func linuxMode(m fs.FileMode) uint64 {
+	l := uint64(m.Perm())
+	switch {
+	case m.IsDir():
+		l |= cpio.S_IFDIR
+	case m&fs.ModeSymlink != 0:
+		l |= cpio.S_IFLNK
+	default:
+		l |= cpio.S_IFREG
+	}
+	if m&fs.ModeSetuid != 0 {
+		l |= cpio.S_ISUID
+	}
+	if m&fs.ModeSetgid != 0 {
+		l |= cpio.S_ISGID
+	}
+	if m&fs.ModeSticky != 0 {
+		l |= cpio.S_ISVTX
+	}
+	return l
+}
+
+// lazyFile is an io.ReaderAt for a file in an fs.FS. It is opened on
+// first use, and closed by the cpio writer when it is done, so that
+// archiving 90,000 files does not need 90,000 open files.
+type lazyFile struct {
+	fsys fs.FS
+	name string
+	f    fs.File
+	r    io.ReaderAt
+}
+
+func (l *lazyFile) ReadAt(p []byte, off int64) (int, error) {
+	if l.r == nil {
+		f, err := l.fsys.Open(l.name)
+		if err != nil {
+			return 0, err
+		}
+		l.f = f
+		r, ok := f.(io.ReaderAt)
+		if !ok {
+			dat, err := io.ReadAll(f)
+			if err != nil {
+				return 0, err
+			}
+			r = bytes.NewReader(dat)
+		}
+		l.r = r
+	}
+	return l.r.ReadAt(p, off)
+}
+
+func (l *lazyFile) Close() error {
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f, l.r = nil, nil
+	return err
+}
+
+// fsRecord returns the cpio record for name in fsys, with inode ino.
+func fsRecord(fsys fs.FS, name string, d fs.DirEntry, ino uint64) (cpio.Record, error) {
+	fi, err := d.Info()
+	if err != nil {
+		return cpio.Record{}, err
+	}
+	info := cpio.Info{
+		Name:  name,
+		Ino:   ino,
+		Mode:  linuxMode(fi.Mode()),
+		NLink: 1,
+		MTime: uint64(fi.ModTime().Unix()),
+	}
+	switch {
+	case fi.IsDir():
+		info.NLink = 2
+		return cpio.Record{Info: info}, nil
+	case fi.Mode()&fs.ModeSymlink != 0:
+		t, err := readLink(fsys, name)
+		if err != nil {
+			return cpio.Record{}, err
+		}
+		return cpio.StaticRecord([]byte(t), info), nil
+	case !fi.Mode().IsRegular():
+		return cpio.Record{}, fmt.Errorf("%q: type %v is not supported", name, fi.Mode().Type())
+	}
+	info.FileSize = uint64(fi.Size())
+	return cpio.Record{Info: info, ReaderAt: &lazyFile{fsys: fsys, name: name}}, nil
+}
+
+// ramfs writes a cpio of fsys to out.
+func (b *Builder) ramfs(fsys fs.FS, out string) error {
+	var base []cpio.Record
+	if b.Base != "" {
+		var err error
+		if base, err = readBase(b.Base); err != nil {
+			return err
+		}
+	}
+	to, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer to.Close()
+	log.Printf("Archiving to %v", out)
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		return fmt.Errorf("Format %q not supported: %v", "newc", err)
+	}
+
+	if len(b.Early) > 0 {
+		V("Write early cpio from %q", b.Early)
+		if err := early(to, b.Early); err != nil {
+			return fmt.Errorf("early cpio: %v", err)
+		}
+	}
+	method := b.Compress
+	if method == "" && len(b.Early) > 0 {
+		method = "gzip"
+	}
+	cw, err := compressor(to, method)
+	if err != nil {
+		return err
+	}
+	rw := archiver.Writer(cw)
+
+	var recs []cpio.Record
+	if err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if b.bootOnly[name] {
+			V("Leave %q for the stick", name)
+			return nil
+		}
+		V("Archive %q", name)
+		rec, err := fsRecord(fsys, name, d, uint64(len(recs)+2))
+		if err != nil {
+			return fmt.Errorf("Getting record of %q failed: %v", name, err)
+		}
+		recs = append(recs, rec)
+		return nil
+	}); err != nil {
+		return err
+	}
+	if b.Base != "" {
+		V("Merge with base %q, conflict policy %q", b.Base, b.Conflict)
+		if recs, err = merge(base, recs, b.bin, b.Conflict); err != nil {
+			return err
+		}
+	}
+	for _, rec := range recs {
+		if err := rw.WriteRecord(rec); err != nil {
+			return fmt.Errorf("Writing record %q failed: %v", rec.Name, err)
+		}
+	}
+	if err := cpio.WriteTrailer(rw); err != nil {
+		return fmt.Errorf("Error writing trailer record: %v", err)
+	}
+	return cw.Close()
+}
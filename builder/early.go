@@ -0,0 +1,146 @@
+// Copyright 2022 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package builder
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/cpio"
+)
+
+// The kernel looks for early microcode at this path in an uncompressed
+// cpio at the very start of the initramfs.
+const microcode = "kernel/x86/microcode"
+
+// ucodeNames maps the usual linux-firmware directory names
+// to the file name the kernel expects.
+var ucodeNames = map[string]string{
+	"intel-ucode": "GenuineIntel.bin",
+	"amd-ucode":   "AuthenticAMD.bin",
+}
+
+// earlyDest returns the name in the early cpio of the host path p.
+func earlyDest(p string, isDir bool) (string, error) {
+	b := filepath.Base(p)
+	if !isDir {
+		return filepath.Join(microcode, b), nil
+	}
+	if n, ok := ucodeNames[b]; ok {
+		return filepath.Join(microcode, n), nil
+	}
+	return "", fmt.Errorf("%q: can not guess a name for a directory, use %s:dest", p, p)
+}
+
+// notUcode are suffixes of files found next to microcode that are not
+// microcode, like the signatures in amd-ucode.
+var notUcode = []string{".asc", ".sig", ".md", ".txt"}
+
+// isUcode returns false for names of files that are not microcode:
+// hidden files, READMEs, licenses, signatures.
+func isUcode(n string) bool {
+	u := strings.ToUpper(n)
+	if strings.HasPrefix(n, ".") || strings.HasPrefix(u, "README") || strings.HasPrefix(u, "LICENSE") {
+		return false
+	}
+	for _, s := range notUcode {
+		if strings.HasSuffix(n, s) {
+			return false
+		}
+	}
+	return true
+}
+
+// earlyFiles returns the regular microcode files in directory d, in
+// name order, to be concatenated.
+func earlyFiles(d string) ([]string, error) {
+	ents, err := os.ReadDir(d)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, e := range ents {
+		if !e.Type().IsRegular() || !isUcode(e.Name()) {
+			V("early: skipping %q", filepath.Join(d, e.Name()))
+			continue
+		}
+		files = append(files, filepath.Join(d, e.Name()))
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// early writes an uncompressed cpio to w, built from specs.
+// Each spec is host[:dest]. Host may be a file or a directory, all of
+// whose regular files but signatures and documentation are used, in
+// name order. Everything with the same dest is concatenated,
+// which is how microcode for many CPUs ends up in GenuineIntel.bin.
+// If dest is not given, it is guessed: files go into kernel/x86/microcode,
+// and intel-ucode and amd-ucode directories become GenuineIntel.bin and
+// AuthenticAMD.bin.
+func early(w io.Writer, specs []string) error {
+	var (
+		order    []string
+		contents = map[string][]byte{}
+		dirs     = map[string]bool{}
+	)
+	for _, spec := range specs {
+		host, dest, _ := strings.Cut(spec, ":")
+		fi, err := os.Stat(host)
+		if err != nil {
+			return err
+		}
+		if dest == "" {
+			if dest, err = earlyDest(host, fi.IsDir()); err != nil {
+				return err
+			}
+		}
+		dest = cpio.Normalize(dest)
+		srcs := []string{host}
+		if fi.IsDir() {
+			if srcs, err = earlyFiles(host); err != nil {
+				return err
+			}
+		}
+		for _, src := range srcs {
+			dat, err := os.ReadFile(src)
+			if err != nil {
+				return err
+			}
+			V("early: %q -> %q", src, dest)
+			if _, ok := contents[dest]; !ok {
+				order = append(order, dest)
+			}
+			contents[dest] = append(contents[dest], dat...)
+		}
+		for d := filepath.Dir(dest); d != "."; d = filepath.Dir(d) {
+			dirs[d] = true
+		}
+	}
+
+	var recs []cpio.Record
+	for d := range dirs {
+		recs = append(recs, cpio.Directory(d, 0755))
+	}
+	// Parents sort before their children.
+	sort.Slice(recs, func(i, j int) bool { return recs[i].Name < recs[j].Name })
+	for _, n := range order {
+		recs = append(recs, cpio.StaticFile(n, string(contents[n]), 0644))
+	}
+
+	archiver, err := cpio.Format("newc")
+	if err != nil {
+		return err
+	}
+	rw := archiver.Writer(w)
+	if err := cpio.WriteRecords(rw, recs); err != nil {
+		return err
+	}
+	return cpio.WriteTrailer(rw)
+}
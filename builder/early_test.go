@@ -0,0 +1,56 @@
+// Copyright 2022 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package builder
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/cpio"
+)
+
+func TestEarly(t *testing.T) {
+	d := filepath.Join(t.TempDir(), "amd-ucode")
+	if err := os.MkdirAll(filepath.Join(d, "old"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for n, dat := range map[string]string{
+		"microcode_amd_fam19h.bin":     "19",
+		"microcode_amd_fam17h.bin":     "17",
+		"microcode_amd_fam17h.bin.asc": "signature",
+		"README":                       "readme",
+		"old/microcode_amd.bin":        "old",
+	} {
+		if err := os.WriteFile(filepath.Join(d, n), []byte(dat), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	if err := early(&buf, []string{d}); err != nil {
+		t.Fatal(err)
+	}
+	recs, err := cpio.ReadAllRecords(cpio.Newc.Reader(bytes.NewReader(buf.Bytes())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, r := range recs {
+		names = append(names, r.Name)
+	}
+	want := []string{"kernel", "kernel/x86", "kernel/x86/microcode", "kernel/x86/microcode/AuthenticAMD.bin"}
+	if len(names) != len(want) {
+		t.Fatalf("records: got %q, want %q", names, want)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Errorf("record %d: got %q, want %q", i, names[i], want[i])
+		}
+	}
+	if dat, err := recordData(recs[len(recs)-1]); err != nil || string(dat) != "1719" {
+		t.Errorf("AuthenticAMD.bin: got %q, %v, want %q, nil", dat, err, "1719")
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright 2022 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package builder
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The image gets a minimal /etc, so that tools that look up users,
+// hosts or the OS find something. Overlays replace any of it.
+
+// etc adds passwd, group, hostname, hosts, resolv.conf and os-release to
+// the image. Plan 9 has no use for them.
+func (b *Builder) etc() {
+	if b.OS == "plan9" {
+		return
+	}
+	sh := fmt.Sprintf("/%s_%s/bin/elvish", b.OS, b.Arch)
+	files := []struct{ n, dat string }{
+		{"passwd", "root:x:0:0:root:/:" + sh + "\nnobody:x:65534:65534:nobody:/:/bin/false\n"},
+		{"group", "root:x:0:\nnogroup:x:65534:\n"},
+		{"hostname", "sourcery\n"},
+		{"hosts", "127.0.0.1\tlocalhost sourcery\n::1\tlocalhost sourcery\n"},
+		// The resolver of QEMU's user network; dhclient replaces it.
+		{"resolv.conf", "nameserver 10.0.2.3\n"},
+		{"os-release", b.osRelease()},
+	}
+	for _, f := range files {
+		b.img.WriteFile("etc/"+f.n, []byte(f.dat), 0644)
+	}
+}
+
+// osRelease returns an os-release(5) describing the build.
+func (b *Builder) osRelease() string {
+	var s strings.Builder
+	for _, v := range []struct{ n, v string }{
+		{"NAME", "sourcery"},
+		{"ID", "sourcery"},
+		{"PRETTY_NAME", "sourcery " + b.Version + " " + b.OS + "_" + b.Arch},
+		{"HOME_URL", "https://github.com/u-root/sourcery"},
+		{"BUILD_ID", fmt.Sprintf("%08x", b.id)},
+		{"SOURCERY_GO", b.Version},
+		{"SOURCERY_TARGET", b.OS + "_" + b.Arch},
+		{"SOURCERY_REPOS", strings.Join(b.Repos, " ")},
+		{"SOURCERY_DATE", b.img.mtime.UTC().Format("2006-01-02T15:04:05Z")},
+	} {
+		fmt.Fprintf(&s, "%s=%q\n", v.n, v.v)
+	}
+	return s.String()
+}
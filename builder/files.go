@@ -0,0 +1,174 @@
+// Copyright 2022 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package builder
+
+import (
+	"debug/elf"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// Not everything on a stick is Go: firmware utilities, a static
+// busybox, data files. Files are host[:dest] files or directories
+// copied into the image, at dest or, by default, at the same path as
+// on the host. Dynamically linked ELF binaries also get their shared
+// libraries, and the interpreter. With a sysroot, they are found in it,
+// for any target; without, at the paths the interpreter finds them at
+// on the host, as u-root's builder does, which means running the
+// interpreter, so only binaries for the host's architecture can be
+// resolved, and the libraries land at the host's paths.
+
+// elfMachines are the ELF machines of the Go architectures.
+var elfMachines = map[string]elf.Machine{
+	"386":      elf.EM_386,
+	"amd64":    elf.EM_X86_64,
+	"arm":      elf.EM_ARM,
+	"arm64":    elf.EM_AARCH64,
+	"mips":     elf.EM_MIPS,
+	"mipsle":   elf.EM_MIPS,
+	"mips64":   elf.EM_MIPS,
+	"mips64le": elf.EM_MIPS,
+	"ppc64":    elf.EM_PPC64,
+	"ppc64le":  elf.EM_PPC64,
+	"riscv64":  elf.EM_RISCV,
+	"s390x":    elf.EM_S390,
+}
+
+// checkFiles returns an error for files that are not host[:dest].
+func checkFiles(files []string) error {
+	for _, f := range files {
+		if host, _, _ := strings.Cut(f, ":"); host == "" {
+			return fmt.Errorf("files %q: want host[:dest]", f)
+		}
+	}
+	return nil
+}
+
+// splitFiles splits host[:dest] files into the host path and its
+// destination in the image.
+func splitFiles(f string) (string, string, error) {
+	host, dest, ok := strings.Cut(f, ":")
+	if !ok {
+		abs, err := filepath.Abs(host)
+		if err != nil {
+			return "", "", err
+		}
+		dest = filepath.ToSlash(abs)
+	}
+	return host, path.Clean(strings.TrimPrefix(dest, "/")), nil
+}
+
+// dynamic returns true if the file at p is a dynamically linked ELF
+// binary. It returns an error if it is one for another machine than
+// the target.
+func (b *Builder) dynamic(p string) (bool, error) {
+	f, err := elf.Open(p)
+	if err != nil {
+		// Not an ELF.
+		return false, nil
+	}
+	defer f.Close()
+	m, ok := elfMachines[b.Arch]
+	foreign := ok && f.Machine != m
+	for _, prog := range f.Progs {
+		if prog.Type != elf.PT_INTERP {
+			continue
+		}
+		if foreign {
+			return false, fmt.Errorf("%q is for %v, not %s", p, f.Machine, b.Arch)
+		}
+		return true, nil
+	}
+	if foreign && f.Type == elf.ET_EXEC {
+		log.Printf("files: %q is for %v, not %s", p, f.Machine, b.Arch)
+	}
+	return false, nil
+}
+
+// addFiles adds the files, and the shared libraries of the dynamically
+// linked binaries among them, to the image.
+func (b *Builder) addFiles() error {
+	bins := map[string]string{}
+	for _, f := range b.Files {
+		host, dest, err := splitFiles(f)
+		if err != nil {
+			return fmt.Errorf("files %q: %v", f, err)
+		}
+		if err := b.img.AddDir(host, dest); err != nil {
+			return fmt.Errorf("files %q: %v", f, err)
+		}
+		if err := filepath.WalkDir(host, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || !d.Type().IsRegular() {
+				return err
+			}
+			dyn, err := b.dynamic(p)
+			if !dyn || err != nil {
+				return err
+			}
+			r, err := filepath.Rel(host, p)
+			bins[p] = path.Join(dest, filepath.ToSlash(r))
+			return err
+		}); err != nil {
+			return fmt.Errorf("files %q: %v", f, err)
+		}
+	}
+	if len(bins) == 0 {
+		return nil
+	}
+	if b.Sysroot != "" {
+		return b.addSysrootLibs(bins)
+	}
+	if b.OS != runtime.GOOS || b.Arch != runtime.GOARCH {
+		return fmt.Errorf("files: %q are dynamically linked, and their libraries can only be found on a %s_%s host, or with a sysroot", binNames(bins), b.OS, b.Arch)
+	}
+	names := binNames(bins)
+	libs, err := sharedLibs(names)
+	if err != nil {
+		return fmt.Errorf("files: shared libraries of %q: %v", names, err)
+	}
+	for _, l := range libs {
+		if _, ok := bins[l]; ok {
+			continue
+		}
+		if err := b.img.AddDir(l, strings.TrimPrefix(filepath.ToSlash(l), "/")); err != nil {
+			return fmt.Errorf("files: %v", err)
+		}
+	}
+	return nil
+}
+
+// binNames returns the host paths of bins, sorted.
+func binNames(bins map[string]string) []string {
+	var names []string
+	for p := range bins {
+		names = append(names, p)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// addSysrootLibs adds the shared libraries of bins, from the sysroot,
+// to the image.
+func (b *Builder) addSysrootLibs(bins map[string]string) error {
+	libs, err := sysrootLibs(b.Sysroot, bins)
+	if err != nil {
+		return fmt.Errorf("files: %v", err)
+	}
+	for dest, host := range libs {
+		fi, err := os.Stat(host)
+		if err != nil {
+			return fmt.Errorf("files: %v", err)
+		}
+		b.img.CopyFile(strings.TrimPrefix(dest, "/"), host, fi.Mode().Perm())
+	}
+	return nil
+}
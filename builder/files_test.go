@@ -0,0 +1,205 @@
+// Copyright 2022 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package builder
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFiles(t *testing.T) {
+	d := t.TempDir()
+	dat := filepath.Join(d, "fw.bin")
+	if err := os.WriteFile(dat, []byte("firmware"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	files := []string{dat + ":/lib/firmware/fw.bin"}
+	sh, err := exec.LookPath("sh")
+	if err == nil {
+		sh, err = filepath.EvalSymlinks(sh)
+	}
+	dyn := false
+	if err == nil {
+		b := &Builder{Options: Options{Arch: runtime.GOARCH}}
+		dyn, _ = b.dynamic(sh)
+	}
+	if dyn {
+		files = append(files, sh+":bin/sh")
+	}
+
+	b := &Builder{Options: Options{OS: runtime.GOOS, Arch: runtime.GOARCH, Files: files}, img: newOverlay(t.TempDir(), time.Time{})}
+	if err := b.addFiles(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := readFile(b.img, "lib/firmware/fw.bin"); err != nil || got != "firmware" {
+		t.Errorf("lib/firmware/fw.bin: got %q, %v, want %q, nil", got, err, "firmware")
+	}
+	if fi, err := fs.Stat(b.img, "lib/firmware/fw.bin"); err != nil || fi.Mode() != 0600 {
+		t.Errorf("lib/firmware/fw.bin: got %v, %v, want %v, nil", fi.Mode(), err, fs.FileMode(0600))
+	}
+	if !dyn {
+		return
+	}
+	var libc bool
+	for n := range b.img.gen {
+		libc = libc || strings.Contains(n, "libc.so")
+	}
+	if !libc {
+		t.Errorf("%q: no libc in the image", sh)
+	}
+}
+
+// testSection is a section of an ELF file made by testELF.
+type testSection struct {
+	name string
+	typ  elf.SectionType
+	link uint32 // index, counting from 1, of the linked section
+	data []byte
+}
+
+// testDynamic returns a .dynstr and .dynamic, at index i, with the
+// DT_NEEDED libraries needed and a DT_RUNPATH of runpath, if not empty.
+func testDynamic(i uint32, runpath string, needed ...string) []testSection {
+	strs := []byte{0}
+	var dyn bytes.Buffer
+	add := func(tag elf.DynTag, s string) {
+		binary.Write(&dyn, binary.LittleEndian, elf.Dyn64{Tag: int64(tag), Val: uint64(len(strs))})
+		strs = append(append(strs, s...), 0)
+	}
+	for _, n := range needed {
+		add(elf.DT_NEEDED, n)
+	}
+	if runpath != "" {
+		add(elf.DT_RUNPATH, runpath)
+	}
+	binary.Write(&dyn, binary.LittleEndian, elf.Dyn64{Tag: int64(elf.DT_NULL)})
+	return []testSection{
+		{name: ".dynstr", typ: elf.SHT_STRTAB, data: strs},
+		{name: ".dynamic", typ: elf.SHT_DYNAMIC, link: i, data: dyn.Bytes()},
+	}
+}
+
+// testELF returns a little-endian 64-bit ELF file for m, with a
+// PT_INTERP of interp, if not empty, and sections.
+func testELF(m elf.Machine, interp string, sections ...testSection) []byte {
+	const (
+		ehsize = 64
+		phsize = 56
+		shsize = 64
+	)
+	var phnum uint16
+	if interp != "" {
+		phnum = 1
+	}
+	shstr := []byte{0}
+	var data bytes.Buffer
+	off := uint64(ehsize) + uint64(phnum)*phsize
+	shdrs := []elf.Section64{{}}
+	for _, s := range sections {
+		shdrs = append(shdrs, elf.Section64{Name: uint32(len(shstr)), Type: uint32(s.typ), Off: off + uint64(data.Len()), Size: uint64(len(s.data)), Link: s.link, Addralign: 1})
+		if s.typ == elf.SHT_DYNAMIC {
+			shdrs[len(shdrs)-1].Entsize = 16
+		}
+		shstr = append(append(shstr, s.name...), 0)
+		data.Write(s.data)
+	}
+	interpOff := off + uint64(data.Len())
+	data.WriteString(interp + "\x00")
+	shdrs = append(shdrs, elf.Section64{Name: uint32(len(shstr)), Type: uint32(elf.SHT_STRTAB), Off: off + uint64(data.Len()), Size: uint64(len(shstr) + 10), Addralign: 1})
+	shstr = append(shstr, ".shstrtab\x00"...)
+	data.Write(shstr)
+
+	h := elf.Header64{
+		Type:      uint16(elf.ET_DYN),
+		Machine:   uint16(m),
+		Version:   uint32(elf.EV_CURRENT),
+		Phoff:     ehsize,
+		Shoff:     off + uint64(data.Len()),
+		Ehsize:    ehsize,
+		Phentsize: phsize,
+		Phnum:     phnum,
+		Shentsize: shsize,
+		Shnum:     uint16(len(shdrs)),
+		Shstrndx:  uint16(len(shdrs) - 1),
+	}
+	copy(h.Ident[:], elf.ELFMAG)
+	h.Ident[elf.EI_CLASS], h.Ident[elf.EI_DATA], h.Ident[elf.EI_VERSION] = byte(elf.ELFCLASS64), byte(elf.ELFDATA2LSB), byte(elf.EV_CURRENT)
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, h)
+	if interp != "" {
+		binary.Write(&b, binary.LittleEndian, elf.Prog64{Type: uint32(elf.PT_INTERP), Off: interpOff, Filesz: uint64(len(interp) + 1), Memsz: uint64(len(interp) + 1)})
+	}
+	b.Write(data.Bytes())
+	binary.Write(&b, binary.LittleEndian, shdrs)
+	return b.Bytes()
+}
+
+func TestSysroot(t *testing.T) {
+	arch := crossArch()
+	m := elfMachines[arch]
+	root := t.TempDir()
+	const interp = "/lib/ld-linux.so.1"
+	for n, dat := range map[string][]byte{
+		"usr/lib/ld-linux.so.1":       testELF(m, ""),
+		"usr/lib/multi/libc-2.so":     testELF(m, ""),
+		"usr/lib/libc.so.6":           testELF(elf.EM_386, ""),
+		"usr/lib/libflash.so.1":       testELF(m, "", testDynamic(1, "", "libc.so.6")...),
+		"opt/flash/lib/libpci.so.3":   testELF(m, "", testDynamic(1, "", "libc.so.6")...),
+		"etc/ld.so.conf":              []byte("include /etc/ld.so.conf.d/*.conf\n"),
+		"etc/ld.so.conf.d/multi.conf": []byte("# multiarch\n/usr/lib/multi\n"),
+		"opt/flash/bin/flashrom":      testELF(m, interp, testDynamic(1, "$ORIGIN/../lib", "libflash.so.1", "libpci.so.3")...),
+		"opt/flash/bin/not-there":     testELF(m, interp, testDynamic(1, "", "libnone.so.1")...),
+	} {
+		p := filepath.Join(root, n)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, dat, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Merged /usr, as Debian has it.
+	if err := os.Symlink("usr/lib", filepath.Join(root, "lib")); err != nil {
+		t.Fatal(err)
+	}
+	// Absolute links are to the sysroot's root.
+	if err := os.Symlink("/usr/lib/multi/libc-2.so", filepath.Join(root, "usr/lib/multi/libc.so.6")); err != nil {
+		t.Fatal(err)
+	}
+
+	flashrom := filepath.Join(root, "opt/flash/bin/flashrom")
+	b := &Builder{Options: Options{OS: "linux", Arch: arch, Sysroot: root, Files: []string{flashrom + ":opt/flash/bin/flashrom"}}, img: newOverlay(t.TempDir(), time.Time{})}
+	if err := b.addFiles(); err != nil {
+		t.Fatal(err)
+	}
+	for n, want := range map[string]string{
+		"lib/ld-linux.so.1":         "usr/lib/ld-linux.so.1",
+		"usr/lib/multi/libc.so.6":   "usr/lib/multi/libc-2.so",
+		"lib/libflash.so.1":         "usr/lib/libflash.so.1",
+		"opt/flash/lib/libpci.so.3": "opt/flash/lib/libpci.so.3",
+	} {
+		g, ok := b.img.gen[n]
+		if !ok || g.host != filepath.Join(root, want) {
+			t.Errorf("%q: got %+v, want a copy of %q", n, g, want)
+		}
+	}
+	if g, ok := b.img.gen["usr/lib/libc.so.6"]; ok {
+		t.Errorf("usr/lib/libc.so.6, for another machine: got %+v, want none", g)
+	}
+
+	b = &Builder{Options: Options{OS: "linux", Arch: arch, Sysroot: root, Files: []string{filepath.Join(root, "opt/flash/bin/not-there") + ":bin/x"}}, img: newOverlay(t.TempDir(), time.Time{})}
+	if err := b.addFiles(); err == nil || !strings.Contains(err.Error(), "libnone.so.1") {
+		t.Errorf("a missing library: got %v, want an error naming it", err)
+	}
+}
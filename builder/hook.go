@@ -0,0 +1,163 @@
+// Copyright 2022 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package builder
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Hooks run your own steps at points in the build: before and after
+// each phase, as pre-<phase> and post-<phase>. The phases are
+// toolchain, fetch and tidy (once for each repo), module (once for each
+// module), stubs, tools, boot and archive. A hook that fails fails its
+// phase. Hooks do not run for phases skipped on resume.
+//
+// A post-fetch hook might patch a repo; a pre-stubs hook add files to
+// the image; a post-archive hook sign the outputs.
+
+var hookPhases = []string{"toolchain", "fetch", "tidy", "module", "stubs", "tools", "boot", "archive"}
+
+// A Hook is a command or a function to run at a point in the build.
+type Hook struct {
+	// Point is where the hook runs, e.g. post-fetch.
+	Point string
+	// Command is run with the build described in its environment
+	// by the SOURCERY_ variables of HookContext.Env. It is split into
+	// the program and its arguments at white space, with no quoting;
+	// a relative program with a slash in it is from the directory New
+	// is called in.
+	Command string
+	// Func is called.
+	Func func(ctx context.Context, h *HookContext) error
+}
+
+// HookContext describes the point in the build a hook runs at.
+type HookContext struct {
+	*Builder
+	// Point is where the hook runs, e.g. post-fetch.
+	Point string
+	// Repo and Dir are, for fetch and tidy, the repo URL and where
+	// it is in the workspace; for module, the module and its scratch
+	// module.
+	Repo, Dir string
+}
+
+// Env returns the environment variables describing h. The outputs,
+// SOURCERY_TREE among them, are set only if they are written; the
+// image is only in memory until archive, and Go hooks change it with
+// WriteFile.
+func (h *HookContext) Env() []string {
+	env := []string{
+		"SOURCERY_POINT=" + h.Point,
+		"SOURCERY_PHASE=" + strings.SplitN(h.Point, "-", 2)[1],
+		"SOURCERY_WORKSPACE=" + h.Workspace,
+		"SOURCERY_OS=" + h.OS,
+		"SOURCERY_ARCH=" + h.Arch,
+		"SOURCERY_TARGET=" + h.OS + "_" + h.Arch,
+		"SOURCERY_BIN=" + h.bin,
+	}
+	for _, v := range []struct{ n, v string }{
+		{"REPO", h.Repo},
+		{"REPO_DIR", h.Dir},
+		{"CPIO", h.CPIO},
+		{"VFAT", h.VFAT},
+		{"ISO", h.ISO},
+		{"OCI", h.OCI},
+		{"TREE", h.TreeDir()},
+	} {
+		if v.v != "" {
+			env = append(env, "SOURCERY_"+v.n+"="+v.v)
+		}
+	}
+	return env
+}
+
+// checkHooks returns an error for hooks at unknown points.
+func checkHooks(hooks []Hook) error {
+	for _, h := range hooks {
+		ok := false
+		for _, p := range hookPhases {
+			ok = ok || h.Point == "pre-"+p || h.Point == "post-"+p
+		}
+		if !ok {
+			return fmt.Errorf("hook at %q: points are pre- or post- one of %q", h.Point, hookPhases)
+		}
+		if (strings.TrimSpace(h.Command) == "") == (h.Func == nil) {
+			return fmt.Errorf("hook at %q: want one of a command or a function", h.Point)
+		}
+	}
+	return nil
+}
+
+// absHooks returns hooks with the relative programs of their commands
+// made absolute, as the commands run in the workspace.
+func absHooks(hooks []Hook) ([]Hook, error) {
+	abs := append([]Hook{}, hooks...)
+	for i, h := range abs {
+		f := strings.Fields(h.Command)
+		if len(f) == 0 || !strings.Contains(f[0], "/") || filepath.IsAbs(f[0]) {
+			continue
+		}
+		p, err := filepath.Abs(f[0])
+		if err != nil {
+			return nil, fmt.Errorf("hook at %q: %v", h.Point, err)
+		}
+		abs[i].Command = strings.Join(append([]string{p}, f[1:]...), " ")
+	}
+	return abs, nil
+}
+
+// runHooks runs the hooks at point.
+func (b *Builder) runHooks(ctx context.Context, point, repo, dir string) error {
+	h := &HookContext{Builder: b, Point: point, Repo: repo, Dir: dir}
+	for _, hook := range b.Hooks {
+		if hook.Point != point {
+			continue
+		}
+		if hook.Func != nil {
+			V("hook %s: func", point)
+			if err := hook.Func(ctx, h); err != nil {
+				return fmt.Errorf("hook %s: %v", point, err)
+			}
+			continue
+		}
+		V("hook %s: %q", point, hook.Command)
+		f := strings.Fields(hook.Command)
+		c := exec.CommandContext(ctx, f[0], f[1:]...)
+		c.Dir = b.Workspace
+		c.Stdout, c.Stderr = os.Stdout, os.Stderr
+		c.Env = append(os.Environ(), h.Env()...)
+		if err := c.Run(); err != nil {
+			return fmt.Errorf("hook %s: %q: %v", point, hook.Command, err)
+		}
+	}
+	return nil
+}
+
+// phase runs f as phase name of the build, with its hooks. For fetch
+// and tidy, name is the phase and the repo, and dir where it goes.
+func (b *Builder) phase(ctx context.Context, name, dir string, f func() error) error {
+	p, repo, _ := strings.Cut(name, " ")
+	return b.st.phase(name, func() error {
+		if err := b.runHooks(ctx, "pre-"+p, repo, dir); err != nil {
+			return err
+		}
+		if err := f(); err != nil {
+			return err
+		}
+		return b.runHooks(ctx, "post-"+p, repo, dir)
+	})
+}
+
+// WriteFile adds a file to the image, for instance from a hook.
+func (b *Builder) WriteFile(name string, dat []byte, mode fs.FileMode) {
+	b.img.WriteFile(name, dat, mode)
+}
@@ -0,0 +1,713 @@
+// Copyright 2022 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package builder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// This file writes an ISO 9660 image from a tree. Rock Ridge entries
+// carry the real names, modes, times and symlinks; the ISO names are
+// just unique placeholders. Booting is El Torito, with boot images that
+// are already in the tree: a no emulation image for BIOS (isolinux.bin,
+// which gets a boot info table) and a FAT image for EFI. The image
+// starts with an MBR, so it can be dd'ed to a stick as well.
+//
+// Deep directories are not relocated: Linux does not care, and the
+// toolchain and module cache are well past the 8 levels ISO 9660 wants.
+
+const (
+	isoBlock    = 2048
+	isoSysArea  = 16 // blocks before the first volume descriptor
+	isoMaxRec   = 255
+	isoMaxIDLen = 30
+	isoRecBase  = 33
+	rrPX        = 36
+	rrTF        = 12
+	rrCE        = 28
+	susp        = "RRIP_1991A"
+)
+
+// isoOptions are the El Torito and hybrid MBR options.
+type isoOptions struct {
+	// BIOS is the path in the tree of a no emulation boot image.
+	BIOS string
+	// EFI is the path in the tree of an EFI boot FAT image.
+	EFI string
+	// MBR is boot code for the first 432 bytes of the image,
+	// e.g. isohdpfx.bin from syslinux.
+	MBR []byte
+}
+
+type isoNode struct {
+	name     string
+	id       string
+	path     string
+	mode     fs.FileMode
+	size     int64
+	mtime    time.Time
+	target   string
+	parent   *isoNode
+	children []*isoNode
+	num      int    // path table directory number
+	lba      uint32 // start of the extent
+	extent   uint32 // bytes in the extent, for directories
+	nlink    uint32
+}
+
+func (n *isoNode) isDir() bool {
+	return n.mode.IsDir()
+}
+
+func isoTree(fsys fs.FS) (*isoNode, error) {
+	fi, err := fs.Stat(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	root := &isoNode{path: ".", mode: fi.Mode(), mtime: fi.ModTime()}
+	root.parent = root
+	dirs := map[string]*isoNode{".": root}
+	err = fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == "." {
+			return err
+		}
+		t := d.Type()
+		if t&^(fs.ModeDir|fs.ModeSymlink) != 0 {
+			V("iso: skipping %q, type %v", p, t)
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		n := &isoNode{name: d.Name(), path: p, mode: fi.Mode(), mtime: fi.ModTime(), parent: dirs[path.Dir(p)]}
+		switch {
+		case d.IsDir():
+			dirs[p] = n
+		case t&fs.ModeSymlink != 0:
+			if n.target, err = readLink(fsys, p); err != nil {
+				return err
+			}
+		default:
+			n.size = fi.Size()
+			if n.size > 0xffffffff {
+				return fmt.Errorf("%q: %d bytes is too big for one ISO 9660 extent", p, n.size)
+			}
+		}
+		n.parent.children = append(n.parent.children, n)
+		return nil
+	})
+	return root, err
+}
+
+// readLink reads the symlink p in fsys.
+func readLink(fsys fs.FS, p string) (string, error) {
+	if r, ok := fsys.(interface{ ReadLink(string) (string, error) }); ok {
+		return r.ReadLink(p)
+	}
+	return "", fmt.Errorf("%q: can not read symlinks in %T", p, fsys)
+}
+
+// isoClean returns s with only ISO 9660 d-characters.
+func isoClean(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		}
+		return '_'
+	}, s)
+}
+
+// isoIDs assigns unique ISO identifiers to the children of d, sorts the
+// children by them, as ISO 9660 wants, and counts links.
+func isoIDs(d *isoNode) {
+	used := map[string]bool{}
+	d.nlink = 2
+	for _, c := range d.children {
+		base, ext := c.name, ""
+		if i := strings.LastIndex(c.name, "."); i > 0 && !c.isDir() {
+			base, ext = c.name[:i], c.name[i+1:]
+		}
+		base, ext = isoClean(base), isoClean(ext)
+		if len(ext) > 8 {
+			ext = ext[:8]
+		}
+		for i := 0; ; i++ {
+			b := base
+			if i > 0 {
+				b = fmt.Sprintf("%s_%d", base, i)
+			}
+			max := isoMaxIDLen - len(ext) - 1
+			if len(b) > max {
+				b = b[len(b)-max:]
+			}
+			id := b
+			if !c.isDir() {
+				id = b + "." + ext + ";1"
+			}
+			if !used[id] {
+				used[id], c.id = true, id
+				break
+			}
+		}
+		c.nlink = 1
+		if c.isDir() {
+			d.nlink++
+			isoIDs(c)
+		}
+	}
+	sort.Slice(d.children, func(i, j int) bool { return d.children[i].id < d.children[j].id })
+}
+
+func bothEndian16(b []byte, v uint16) {
+	binary.LittleEndian.PutUint16(b, v)
+	binary.BigEndian.PutUint16(b[2:], v)
+}
+
+func bothEndian32(b []byte, v uint32) {
+	binary.LittleEndian.PutUint32(b, v)
+	binary.BigEndian.PutUint32(b[4:], v)
+}
+
+func isoRecDate(t time.Time) []byte {
+	t = t.UTC()
+	return []byte{byte(t.Year() - 1900), byte(t.Month()), byte(t.Day()), byte(t.Hour()), byte(t.Minute()), byte(t.Second()), 0}
+}
+
+func isoVolDate(t time.Time) []byte {
+	return append([]byte(t.UTC().Format("20060102150405")+"00"), 0)
+}
+
+// rockRidge returns the Rock Ridge entries for n, called name in
+// its directory. root is true for the . entry of the root directory,
+// which says Rock Ridge is in use.
+func rockRidge(n *isoNode, name string, root bool) ([]byte, error) {
+	var b bytes.Buffer
+	if root {
+		b.Write([]byte{'S', 'P', 7, 1, 0xbe, 0xef, 0})
+		des, src := "ROCK RIDGE", "SOURCERY"
+		b.Write([]byte{'E', 'R', byte(8 + len(susp) + len(des) + len(src)), 1, byte(len(susp)), byte(len(des)), byte(len(src)), 1})
+		b.WriteString(susp + des + src)
+	}
+	px := make([]byte, rrPX)
+	copy(px, []byte{'P', 'X', rrPX, 1})
+	mode := uint32(n.mode.Perm())
+	if n.mode&fs.ModeSetuid != 0 {
+		mode |= 0o4000
+	}
+	if n.mode&fs.ModeSetgid != 0 {
+		mode |= 0o2000
+	}
+	if n.mode&fs.ModeSticky != 0 {
+		mode |= 0o1000
+	}
+	switch {
+	case n.isDir():
+		mode |= 0o40000
+	case n.target != "":
+		mode |= 0o120000
+	default:
+		mode |= 0o100000
+	}
+	bothEndian32(px[4:], mode)
+	bothEndian32(px[12:], n.nlink)
+	b.Write(px)
+	b.Write(append([]byte{'T', 'F', rrTF, 1, 0x02}, isoRecDate(n.mtime)...))
+	if name != "" {
+		for first := true; first || name != ""; first = false {
+			part := name
+			var flags byte
+			if len(part) > 250 {
+				part, flags = part[:250], 1
+			}
+			name = name[len(part):]
+			b.Write([]byte{'N', 'M', byte(5 + len(part)), 1, flags})
+			b.WriteString(part)
+		}
+	}
+	if n.target != "" {
+		var comps []byte
+		t := n.target
+		if strings.HasPrefix(t, "/") {
+			comps = append(comps, 0x08, 0)
+			t = strings.TrimLeft(t, "/")
+		}
+		for _, c := range strings.Split(t, "/") {
+			switch c {
+			case "":
+			case ".":
+				comps = append(comps, 0x02, 0)
+			case "..":
+				comps = append(comps, 0x04, 0)
+			default:
+				comps = append(comps, 0, byte(len(c)))
+				comps = append(comps, c...)
+			}
+		}
+		if len(comps) > 250 {
+			return nil, fmt.Errorf("%q: symlink target %q is too long", n.path, n.target)
+		}
+		b.Write([]byte{'S', 'L', byte(5 + len(comps)), 1, 0})
+		b.Write(comps)
+	}
+	return b.Bytes(), nil
+}
+
+// isoRecord is a directory record, and the part of its system use
+// area that did not fit and goes in a continuation area.
+type isoRecord struct {
+	n    *isoNode
+	id   []byte
+	su   []byte
+	cont []byte
+	lba  uint32 // of the continuation area
+	off  uint32
+}
+
+func newISORecord(n *isoNode, id []byte, name string, root bool) (*isoRecord, error) {
+	su, err := rockRidge(n, name, root)
+	if err != nil {
+		return nil, err
+	}
+	r := &isoRecord{n: n, id: id, su: su}
+	if r.len() > isoMaxRec {
+		// Keep PX and TF, move the rest to a continuation area.
+		keep := rrPX + rrTF
+		if root {
+			keep = 7
+		}
+		r.su, r.cont = su[:keep:keep], su[keep:]
+	}
+	return r, nil
+}
+
+func (r *isoRecord) len() int {
+	l := isoRecBase + len(r.id)
+	if l%2 == 1 {
+		l++
+	}
+	l += len(r.su)
+	if r.cont != nil {
+		l += rrCE
+	}
+	return l
+}
+
+func (r *isoRecord) bytes() []byte {
+	b := make([]byte, isoRecBase, r.len())
+	b[0] = byte(r.len())
+	n := r.n
+	size := uint32(n.size)
+	if n.isDir() {
+		size = n.extent
+	}
+	if n.target != "" {
+		size = 0
+	}
+	bothEndian32(b[2:], n.lba)
+	bothEndian32(b[10:], size)
+	copy(b[18:], isoRecDate(n.mtime))
+	if n.isDir() {
+		b[25] = 0x02
+	}
+	bothEndian16(b[28:], 1)
+	b[32] = byte(len(r.id))
+	b = append(b, r.id...)
+	if len(r.id)%2 == 0 {
+		b = append(b, 0)
+	}
+	b = append(b, r.su...)
+	if r.cont != nil {
+		ce := make([]byte, rrCE)
+		copy(ce, []byte{'C', 'E', rrCE, 1})
+		bothEndian32(ce[4:], r.lba)
+		bothEndian32(ce[12:], r.off)
+		bothEndian32(ce[20:], uint32(len(r.cont)))
+		b = append(b, ce...)
+	}
+	return b
+}
+
+// isoWriter holds the state of one image being written.
+type isoWriter struct {
+	fsys  fs.FS
+	opt   isoOptions
+	root  *isoNode
+	dirs  []*isoNode // in path table order
+	files []*isoNode
+	recs  map[*isoNode][]*isoRecord
+	conts []*isoRecord
+}
+
+// records returns the directory records of d.
+func (w *isoWriter) records(d *isoNode) ([]*isoRecord, error) {
+	self, err := newISORecord(d, []byte{0}, "", d == w.root)
+	if err != nil {
+		return nil, err
+	}
+	parent, err := newISORecord(d.parent, []byte{1}, "", false)
+	if err != nil {
+		return nil, err
+	}
+	recs := []*isoRecord{self, parent}
+	for _, c := range d.children {
+		r, err := newISORecord(c, []byte(c.id), c.name, false)
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, r)
+	}
+	return recs, nil
+}
+
+// extentSize returns the size of a directory holding recs,
+// where records may not cross a block boundary.
+func extentSize(recs []*isoRecord) uint32 {
+	var off uint32
+	for _, r := range recs {
+		l := uint32(r.len())
+		if off%isoBlock+l > isoBlock {
+			off += isoBlock - off%isoBlock
+		}
+		off += l
+	}
+	return (off + isoBlock - 1) / isoBlock * isoBlock
+}
+
+func blocks(n int64) uint32 {
+	return uint32((n + isoBlock - 1) / isoBlock)
+}
+
+// pathTable returns the path table, in little or big endian.
+func (w *isoWriter) pathTable(order binary.ByteOrder) []byte {
+	var b []byte
+	for _, d := range w.dirs {
+		id := []byte(d.id)
+		if d == w.root {
+			id = []byte{0}
+		}
+		e := make([]byte, 8, 8+len(id)+1)
+		e[0] = byte(len(id))
+		order.PutUint32(e[2:], d.lba)
+		order.PutUint16(e[6:], uint16(d.parent.num))
+		e = append(e, id...)
+		if len(id)%2 == 1 {
+			e = append(e, 0)
+		}
+		b = append(b, e...)
+	}
+	return b
+}
+
+func (w *isoWriter) lookup(p string) (*isoNode, error) {
+	for _, n := range w.files {
+		if n.path == path.Clean(p) {
+			return n, nil
+		}
+	}
+	return nil, fmt.Errorf("boot image %q is not a file in the tree", p)
+}
+
+// catalog returns the El Torito boot catalog.
+func (w *isoWriter) catalog(bios, efi *isoNode) []byte {
+	b := make([]byte, isoBlock)
+	entry := func(e []byte, n *isoNode, count uint16) {
+		e[0] = 0x88
+		binary.LittleEndian.PutUint16(e[6:], count)
+		binary.LittleEndian.PutUint32(e[8:], n.lba)
+	}
+	// The validation entry names the platform of the default entry.
+	b[0] = 1
+	if bios == nil {
+		b[1] = 0xef
+	}
+	copy(b[4:], "SOURCERY")
+	b[30], b[31] = 0x55, 0xaa
+	var sum uint16
+	for i := 0; i < 32; i += 2 {
+		sum += binary.LittleEndian.Uint16(b[i:])
+	}
+	binary.LittleEndian.PutUint16(b[28:], -sum)
+
+	efiCount := func() uint16 {
+		if c := (efi.size + 511) / 512; c <= 0xffff {
+			return uint16(c)
+		}
+		// Too big to say; firmware uses the whole image.
+		return 0
+	}
+	switch {
+	case bios != nil:
+		// isolinux wants 4 virtual sectors loaded.
+		entry(b[32:], bios, 4)
+		if efi != nil {
+			b[64], b[65] = 0x91, 0xef
+			binary.LittleEndian.PutUint16(b[66:], 1)
+			entry(b[96:], efi, efiCount())
+		}
+	case efi != nil:
+		entry(b[32:], efi, efiCount())
+	}
+	return b
+}
+
+// bootInfoTable patches the boot info table isolinux wants
+// into the boot image dat, found at lba.
+func bootInfoTable(dat []byte, lba uint32) {
+	if len(dat) < 64 {
+		return
+	}
+	var sum uint32
+	for i := 64; i+4 <= len(dat); i += 4 {
+		sum += binary.LittleEndian.Uint32(dat[i:])
+	}
+	binary.LittleEndian.PutUint32(dat[8:], isoSysArea)
+	binary.LittleEndian.PutUint32(dat[12:], lba)
+	binary.LittleEndian.PutUint32(dat[16:], uint32(len(dat)))
+	binary.LittleEndian.PutUint32(dat[20:], sum)
+}
+
+func padString(b []byte, s string) {
+	for i := range b {
+		b[i] = ' '
+	}
+	copy(b, s)
+}
+
+func (w *isoWriter) pvd(total, ptSize, lpt, mpt uint32) []byte {
+	b := make([]byte, isoBlock)
+	b[0] = 1
+	copy(b[1:], "CD001")
+	b[6] = 1
+	padString(b[8:40], "LINUX")
+	padString(b[40:72], "SOURCERY")
+	bothEndian32(b[80:], total)
+	bothEndian16(b[120:], 1)
+	bothEndian16(b[124:], 1)
+	bothEndian16(b[128:], isoBlock)
+	bothEndian32(b[132:], ptSize)
+	binary.LittleEndian.PutUint32(b[140:], lpt)
+	binary.BigEndian.PutUint32(b[148:], mpt)
+	// The root record here is the bare 34 byte form.
+	root := &isoRecord{n: w.root, id: []byte{0}}
+	copy(b[156:190], root.bytes())
+	padString(b[190:318], "")
+	padString(b[318:446], "")
+	padString(b[446:574], "")
+	padString(b[574:702], "SOURCERY")
+	padString(b[702:813], "")
+	date := isoVolDate(w.root.mtime)
+	copy(b[813:], date)
+	copy(b[830:], date)
+	copy(b[847:], "0000000000000000")
+	copy(b[864:], date)
+	b[881] = 1
+	return b
+}
+
+// iso writes an ISO 9660 image of fsys to out.
+func iso(fsys fs.FS, out string, opt isoOptions) error {
+	root, err := isoTree(fsys)
+	if err != nil {
+		return err
+	}
+	isoIDs(root)
+	w := &isoWriter{fsys: fsys, opt: opt, root: root, recs: map[*isoNode][]*isoRecord{}}
+
+	// Path table order is breadth first, and the ids are sorted.
+	for q := []*isoNode{root}; len(q) > 0; q = q[1:] {
+		d := q[0]
+		w.dirs = append(w.dirs, d)
+		d.num = len(w.dirs)
+		for _, c := range d.children {
+			if c.isDir() {
+				q = append(q, c)
+			} else if c.target == "" {
+				w.files = append(w.files, c)
+			}
+		}
+	}
+
+	var contSize uint32
+	for _, d := range w.dirs {
+		recs, err := w.records(d)
+		if err != nil {
+			return err
+		}
+		w.recs[d] = recs
+		d.extent = extentSize(recs)
+		for _, r := range recs {
+			if r.cont == nil {
+				continue
+			}
+			// Continuation areas may not cross a block either.
+			l := uint32(len(r.cont))
+			if contSize%isoBlock+l > isoBlock {
+				contSize += isoBlock - contSize%isoBlock
+			}
+			r.off = contSize
+			contSize += l
+			w.conts = append(w.conts, r)
+		}
+	}
+
+	var bios, efi *isoNode
+	if opt.BIOS != "" {
+		if bios, err = w.lookup(opt.BIOS); err != nil {
+			return err
+		}
+	}
+	if opt.EFI != "" {
+		if efi, err = w.lookup(opt.EFI); err != nil {
+			return err
+		}
+	}
+	boot := bios != nil || efi != nil
+
+	// Lay it all out.
+	lba := uint32(isoSysArea + 2) // primary volume descriptor and terminator
+	if boot {
+		lba++
+	}
+	ptSize := uint32(len(w.pathTable(binary.LittleEndian)))
+	lpt := lba
+	lba += blocks(int64(ptSize))
+	mpt := lba
+	lba += blocks(int64(ptSize))
+	var catLBA uint32
+	if boot {
+		catLBA = lba
+		lba++
+	}
+	for _, d := range w.dirs {
+		d.lba = lba
+		lba += d.extent / isoBlock
+	}
+	// Continuation areas go after the directories: libarchive
+	// reads sequentially and will not go back for them.
+	contLBA := lba
+	lba += blocks(int64(contSize))
+	for _, r := range w.conts {
+		r.lba, r.off = contLBA+r.off/isoBlock, r.off%isoBlock
+	}
+	for _, f := range w.files {
+		f.lba = lba
+		lba += blocks(f.size)
+	}
+	total := lba
+	V("iso: %d blocks, %d directories, %d files", total, len(w.dirs), len(w.files))
+
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Truncate(int64(total) * isoBlock); err != nil {
+		return err
+	}
+	at := func(dat []byte, lba uint32, off uint32) error {
+		_, err := f.WriteAt(dat, int64(lba)*isoBlock+int64(off))
+		return err
+	}
+
+	// The hybrid MBR: one partition for the whole image, and one
+	// for the EFI image, so firmware booting it as a disk finds it.
+	m := make([]byte, sectorSize)
+	copy(m[:440], opt.MBR)
+	binary.LittleEndian.PutUint32(m[440:], diskID(out))
+	part := func(i int, typ byte, boot bool, start, count uint32) {
+		copy(m[446+16*i:], mbr(0, typ, boot, start, count)[446:462])
+	}
+	part(0, 0x17, true, 0, total*isoBlock/sectorSize)
+	if efi != nil {
+		part(1, 0xef, false, efi.lba*isoBlock/sectorSize, uint32((efi.size+sectorSize-1)/sectorSize))
+	}
+	m[510], m[511] = 0x55, 0xaa
+	if err := at(m, 0, 0); err != nil {
+		return err
+	}
+
+	vd := uint32(isoSysArea)
+	if err := at(w.pvd(total, ptSize, lpt, mpt), vd, 0); err != nil {
+		return err
+	}
+	vd++
+	if boot {
+		br := make([]byte, isoBlock)
+		copy(br[1:], "CD001")
+		br[6] = 1
+		copy(br[7:], "EL TORITO SPECIFICATION")
+		binary.LittleEndian.PutUint32(br[71:], catLBA)
+		if err := at(br, vd, 0); err != nil {
+			return err
+		}
+		vd++
+		if err := at(w.catalog(bios, efi), catLBA, 0); err != nil {
+			return err
+		}
+	}
+	if err := at([]byte{255, 'C', 'D', '0', '0', '1', 1}, vd, 0); err != nil {
+		return err
+	}
+	if err := at(w.pathTable(binary.LittleEndian), lpt, 0); err != nil {
+		return err
+	}
+	if err := at(w.pathTable(binary.BigEndian), mpt, 0); err != nil {
+		return err
+	}
+	for _, r := range w.conts {
+		if err := at(r.cont, r.lba, r.off); err != nil {
+			return err
+		}
+	}
+	for _, d := range w.dirs {
+		var off uint32
+		for _, r := range w.recs[d] {
+			b := r.bytes()
+			if off%isoBlock+uint32(len(b)) > isoBlock {
+				off += isoBlock - off%isoBlock
+			}
+			if err := at(b, d.lba, off); err != nil {
+				return err
+			}
+			off += uint32(len(b))
+		}
+	}
+	for _, n := range w.files {
+		if n == bios {
+			dat, err := fs.ReadFile(fsys, n.path)
+			if err != nil {
+				return err
+			}
+			bootInfoTable(dat, n.lba)
+			if err := at(dat, n.lba, 0); err != nil {
+				return err
+			}
+			continue
+		}
+		src, err := fsys.Open(n.path)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(&offsetWriter{f, int64(n.lba) * isoBlock}, io.LimitReader(src, n.size))
+		src.Close()
+		if err != nil {
+			return fmt.Errorf("%q: %v", n.path, err)
+		}
+	}
+	return f.Close()
+}
@@ -0,0 +1,123 @@
+// Copyright 2022 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package builder
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// isoEntry is what the test reads back of a directory record.
+type isoEntry struct {
+	lba, size uint32
+	dir       bool
+	name      string // from NM
+	mode      uint32 // from PX
+}
+
+// readISODir returns the records, but . and .., of the directory at
+// lba, size bytes long, in img.
+func readISODir(t *testing.T, img []byte, lba, size uint32) []isoEntry {
+	t.Helper()
+	var ents []isoEntry
+	ext := img[lba*isoBlock : lba*isoBlock+size]
+	for off := 0; off < len(ext); {
+		l := int(ext[off])
+		if l == 0 {
+			// Records do not cross blocks.
+			off = (off/isoBlock + 1) * isoBlock
+			continue
+		}
+		r := ext[off : off+l]
+		off += l
+		idLen := int(r[32])
+		if idLen == 1 && (r[33] == 0 || r[33] == 1) {
+			continue
+		}
+		e := isoEntry{lba: binary.LittleEndian.Uint32(r[2:]), size: binary.LittleEndian.Uint32(r[10:]), dir: r[25]&2 != 0}
+		su := r[isoRecBase+idLen+(idLen+1)%2:]
+		for len(su) >= 4 {
+			sl := int(su[2])
+			if sl < 4 || sl > len(su) {
+				t.Fatalf("bad system use entry %q", su)
+			}
+			switch string(su[:2]) {
+			case "NM":
+				e.name += string(su[5:sl])
+			case "PX":
+				e.mode = binary.LittleEndian.Uint32(su[4:])
+			case "CE":
+				cl, co, cn := binary.LittleEndian.Uint32(su[4:]), binary.LittleEndian.Uint32(su[12:]), binary.LittleEndian.Uint32(su[20:])
+				su = append(su[sl:sl:sl], img[cl*isoBlock+co:cl*isoBlock+co+cn]...)
+				continue
+			}
+			su = su[sl:]
+		}
+		ents = append(ents, e)
+	}
+	return ents
+}
+
+func TestISO(t *testing.T) {
+	long := strings.Repeat("a_long_name_", 12) + ".go"
+	fsys := fstest.MapFS{
+		"linux_amd64/bin/init": {Data: []byte("init"), Mode: 0755},
+		"src/" + long:          {Data: []byte("package main\n"), Mode: 0644},
+	}
+	out := filepath.Join(t.TempDir(), "iso")
+	if err := iso(fsys, out, isoOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	img, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pvd := img[isoSysArea*isoBlock:]
+	if pvd[0] != 1 || string(pvd[1:6]) != "CD001" || strings.TrimSpace(string(pvd[40:72])) != "SOURCERY" {
+		t.Fatalf("bad primary volume descriptor %q", pvd[:72])
+	}
+	if n := binary.LittleEndian.Uint32(pvd[80:]); int(n)*isoBlock != len(img) {
+		t.Errorf("volume space: %d blocks, image is %d bytes", n, len(img))
+	}
+	root := pvd[156:]
+	find := func(ents []isoEntry, name string) isoEntry {
+		t.Helper()
+		for _, e := range ents {
+			if e.name == name {
+				return e
+			}
+		}
+		t.Fatalf("no %q in %+v", name, ents)
+		return isoEntry{}
+	}
+	top := readISODir(t, img, binary.LittleEndian.Uint32(root[2:]), binary.LittleEndian.Uint32(root[10:]))
+	if len(top) != 2 {
+		t.Errorf("root: got %+v, want linux_amd64 and src", top)
+	}
+	la := find(top, "linux_amd64")
+	if !la.dir || la.mode != 0o40555 {
+		t.Errorf("linux_amd64: got dir %v, mode %o, want a 40555 directory, as fstest.MapFS makes them", la.dir, la.mode)
+	}
+	bin := find(readISODir(t, img, la.lba, la.size), "bin")
+	init := find(readISODir(t, img, bin.lba, bin.size), "init")
+	if init.mode != 0o100755 {
+		t.Errorf("init: mode %o, want 100755", init.mode)
+	}
+	if got := string(img[init.lba*isoBlock : init.lba*isoBlock+init.size]); got != "init" {
+		t.Errorf("init: got %q, want %q", got, "init")
+	}
+	src := find(top, "src")
+	f := find(readISODir(t, img, src.lba, src.size), long)
+	if f.mode != 0o100644 {
+		t.Errorf("%q: mode %o, want 100644", long, f.mode)
+	}
+	if got := string(img[f.lba*isoBlock : f.lba*isoBlock+f.size]); got != "package main\n" {
+		t.Errorf("%q: got %q, want %q", long, got, "package main\n")
+	}
+}
@@ -0,0 +1,320 @@
+// Copyright 2022 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package builder
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"debug/elf"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Kernel modules come from a kernel's modules directory, e.g.
+// /lib/modules/6.1.0-13-amd64, as depmod left it. They are picked by
+// name, or by matching the modaliases of the hardware, as read from
+// /sys/bus/*/devices/*/modalias on the machine, against modules.alias,
+// and come with the modules they depend on, from modules.dep. They go,
+// decompressed, in /$OS_$ARCH/lib/modules, with modules.load listing
+// them in the order to load them, dependencies first, for init. The
+// firmware they name goes in /lib/firmware.
+
+// moduleLoadList names the list of modules in load order, in the
+// modules directory in the image.
+const moduleLoadList = "modules.load"
+
+// kmodSuffixes are the suffixes of compressed modules.
+var kmodSuffixes = []string{".xz", ".zst", ".gz"}
+
+// kmodName returns the name of the module in file p: its base name,
+// without .ko and any compression suffix, with - as _, as the kernel
+// names it.
+func kmodName(p string) string {
+	n := path.Base(p)
+	for _, s := range kmodSuffixes {
+		n = strings.TrimSuffix(n, s)
+	}
+	return strings.ReplaceAll(strings.TrimSuffix(n, ".ko"), "-", "_")
+}
+
+// kmodTable is what depmod says about a kernel's modules.
+type kmodTable struct {
+	paths   map[string]string   // module name to path in the modules directory
+	deps    map[string][]string // path to the paths it depends on
+	aliases [][2]string         // modalias pattern and module name
+	builtin map[string]bool     // names of modules built into the kernel
+}
+
+// readKmodTable reads modules.dep, modules.alias and modules.builtin,
+// if there are any, in the modules directory dir.
+func readKmodTable(dir string) (*kmodTable, error) {
+	t := &kmodTable{paths: map[string]string{}, deps: map[string][]string{}, builtin: map[string]bool{}}
+	if err := eachLine(filepath.Join(dir, "modules.dep"), func(l string) error {
+		p, deps, ok := strings.Cut(l, ":")
+		if !ok {
+			return fmt.Errorf("modules.dep: bad line %q", l)
+		}
+		t.paths[kmodName(p)] = p
+		t.deps[p] = strings.Fields(deps)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if err := eachLine(filepath.Join(dir, "modules.alias"), func(l string) error {
+		if f := strings.Fields(l); len(f) == 3 && f[0] == "alias" {
+			t.aliases = append(t.aliases, [2]string{f[1], strings.ReplaceAll(f[2], "-", "_")})
+		}
+		return nil
+	}); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := eachLine(filepath.Join(dir, "modules.builtin"), func(l string) error {
+		t.builtin[kmodName(l)] = true
+		return nil
+	}); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return t, nil
+}
+
+// eachLine calls f with each line of file p that is not blank or a
+// comment.
+func eachLine(p string, f func(string) error) error {
+	fl, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer fl.Close()
+	s := bufio.NewScanner(fl)
+	for s.Scan() {
+		l := strings.TrimSpace(s.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		if err := f(l); err != nil {
+			return err
+		}
+	}
+	return s.Err()
+}
+
+// match returns the names of the modules for modalias a.
+func (t *kmodTable) match(a string) []string {
+	var names []string
+	for _, al := range t.aliases {
+		if ok, _ := path.Match(al[0], a); ok {
+			names = append(names, al[1])
+		}
+	}
+	return names
+}
+
+// order returns the paths of the modules names, and those they depend
+// on, in the order to load them: each after those it depends on.
+// Modules built into the kernel are left out.
+func (t *kmodTable) order(names []string) ([]string, error) {
+	var (
+		paths []string
+		seen  = map[string]bool{}
+		visit func(p string)
+	)
+	visit = func(p string) {
+		if seen[p] {
+			return
+		}
+		seen[p] = true
+		// modprobe loads them from the end of the list.
+		deps := t.deps[p]
+		for i := len(deps) - 1; i >= 0; i-- {
+			visit(deps[i])
+		}
+		paths = append(paths, p)
+	}
+	for _, n := range names {
+		n = strings.ReplaceAll(n, "-", "_")
+		p, ok := t.paths[n]
+		switch {
+		case ok:
+			visit(p)
+		case t.builtin[n]:
+			V("kernel modules: %q is built in", n)
+		default:
+			return nil, fmt.Errorf("no module %q", n)
+		}
+	}
+	return paths, nil
+}
+
+// kmodData returns the contents of module file p, decompressed.
+func kmodData(p string) ([]byte, error) {
+	dat, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	var r io.Reader
+	switch path.Ext(p) {
+	case ".zst":
+		d, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer d.Close()
+		return d.DecodeAll(dat, nil)
+	case ".xz":
+		r, err = xz.NewReader(bytes.NewReader(dat))
+	case ".gz":
+		r, err = gzip.NewReader(bytes.NewReader(dat))
+	default:
+		return dat, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// kmodInfo returns the module's machine, and the values of key in its
+// .modinfo section, e.g. the firmware it loads.
+func kmodInfo(dat []byte, key string) (elf.Machine, []string, error) {
+	f, err := elf.NewFile(bytes.NewReader(dat))
+	if err != nil {
+		return 0, nil, err
+	}
+	s := f.Section(".modinfo")
+	if s == nil {
+		return f.Machine, nil, nil
+	}
+	info, err := s.Data()
+	if err != nil {
+		return 0, nil, err
+	}
+	var vals []string
+	for _, kv := range bytes.Split(info, []byte{0}) {
+		if bytes.HasPrefix(kv, []byte(key+"=")) {
+			vals = append(vals, string(kv[len(key)+1:]))
+		}
+	}
+	return f.Machine, vals, nil
+}
+
+// kmodNames returns the names of the modules asked for by name, and
+// for the modaliases in the Hardware file.
+func (b *Builder) kmodNames(t *kmodTable) ([]string, error) {
+	names := append([]string{}, b.KModules...)
+	if b.Hardware == "" {
+		return names, nil
+	}
+	err := eachLine(b.Hardware, func(a string) error {
+		m := t.match(a)
+		if len(m) == 0 {
+			V("kernel modules: no module for %q", a)
+		}
+		names = append(names, m...)
+		return nil
+	})
+	return names, err
+}
+
+// kmodPaths returns the paths, in the kernel modules directory, of the
+// modules to install, in load order.
+func (b *Builder) kmodPaths() ([]string, error) {
+	if b.KernelModules == "" {
+		return nil, nil
+	}
+	t, err := readKmodTable(b.KernelModules)
+	if err != nil {
+		return nil, err
+	}
+	names, err := b.kmodNames(t)
+	if err != nil {
+		return nil, err
+	}
+	return t.order(names)
+}
+
+// kmodDir returns the modules directory in the image.
+func (b *Builder) kmodDir() string {
+	return path.Join(path.Dir(b.bin), "lib/modules")
+}
+
+// kmods adds the kernel modules, and their firmware, to the image.
+func (b *Builder) kmods() error {
+	paths, err := b.kmodPaths()
+	if err != nil || len(paths) == 0 {
+		return err
+	}
+	dir := b.kmodDir()
+	var list bytes.Buffer
+	for _, p := range paths {
+		host := filepath.Join(b.KernelModules, p)
+		dat, err := kmodData(host)
+		if err != nil {
+			return fmt.Errorf("%q: %v", host, err)
+		}
+		m, fw, err := kmodInfo(dat, "firmware")
+		if err != nil {
+			return fmt.Errorf("%q: %v", host, err)
+		}
+		if want, ok := elfMachines[b.Arch]; ok && m != want {
+			return fmt.Errorf("%q is for %v, not %s", host, m, b.Arch)
+		}
+		n := kmodName(p) + ".ko"
+		V("kernel modules: %q from %q", path.Join(dir, n), host)
+		b.img.WriteFile(path.Join(dir, n), dat, 0644)
+		fmt.Fprintln(&list, n)
+		if b.Firmware != "" {
+			b.firmware(fw)
+		}
+	}
+	b.img.WriteFile(path.Join(dir, moduleLoadList), list.Bytes(), 0644)
+	return nil
+}
+
+// firmware adds the firmware files names, which may be patterns, from
+// the Firmware directory, compressed or not, to /lib/firmware in the
+// image. Modules name firmware they can do without, too, so missing
+// files are not errors.
+func (b *Builder) firmware(names []string) {
+	for _, n := range names {
+		var found bool
+		for _, s := range []string{"", ".zst", ".xz"} {
+			m, err := filepath.Glob(filepath.Join(b.Firmware, n+s))
+			if err != nil {
+				log.Printf("firmware %q: %v", n, err)
+				break
+			}
+			for _, p := range m {
+				r, err := filepath.Rel(b.Firmware, p)
+				if err != nil {
+					log.Printf("firmware %q: %v", p, err)
+					continue
+				}
+				// linux-firmware has many symlinks; copy what
+				// they point at.
+				fi, err := os.Stat(p)
+				if err != nil || !fi.Mode().IsRegular() {
+					V("firmware: skipping %q: %v", p, err)
+					continue
+				}
+				dest := path.Join("lib/firmware", filepath.ToSlash(r))
+				V("firmware: %q from %q", dest, p)
+				b.img.CopyFile(dest, p, 0644)
+				found = true
+			}
+		}
+		if !found {
+			V("firmware: no %q in %q", n, b.Firmware)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2022 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package builder
+
+import (
+	"bytes"
+	"debug/elf"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+func TestKmodOrder(t *testing.T) {
+	d := t.TempDir()
+	for n, dat := range map[string]string{
+		"modules.dep": "kernel/drivers/net/ethernet/intel/e1000e/e1000e.ko.xz: kernel/drivers/ptp/ptp.ko.xz kernel/drivers/pps/pps_core.ko.xz\n" +
+			"kernel/drivers/ptp/ptp.ko.xz: kernel/drivers/pps/pps_core.ko.xz\n" +
+			"kernel/drivers/pps/pps_core.ko.xz:\n" +
+			"kernel/fs/fuse/virtio-fs.ko.zst:\n",
+		"modules.alias":   "# Aliases extracted from modules themselves.\nalias pci:v00008086d000015B8sv*sd*bc*sc*i* e1000e\nalias fs-virtiofs virtio-fs\n",
+		"modules.builtin": "kernel/drivers/block/virtio_blk.ko\n",
+	} {
+		if err := os.WriteFile(filepath.Join(d, n), []byte(dat), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tab, err := readKmodTable(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := append(tab.match("pci:v00008086d000015B8sv00001028sd000007BEbc02sc00i00"), tab.match("fs-virtiofs")...)
+	names = append(names, "virtio_blk", "pps-core")
+	got, err := tab.order(names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"kernel/drivers/pps/pps_core.ko.xz",
+		"kernel/drivers/ptp/ptp.ko.xz",
+		"kernel/drivers/net/ethernet/intel/e1000e/e1000e.ko.xz",
+		"kernel/fs/fuse/virtio-fs.ko.zst",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("order(%q): got %q, want %q", names, got, want)
+	}
+	if _, err := tab.order([]string{"nope"}); err == nil {
+		t.Errorf("order(nope): got nil, want error")
+	}
+}
+
+// testModule returns a kernel module for m with a .modinfo of info.
+func testModule(m elf.Machine, info ...string) []byte {
+	return testELF(m, "", testSection{name: ".modinfo", typ: elf.SHT_PROGBITS, data: []byte(strings.Join(info, "\x00") + "\x00")})
+}
+
+func TestKmods(t *testing.T) {
+	a := testModule(elf.EM_X86_64, "license=GPL", "firmware=fa.bin", "depends=b")
+	b := testModule(elf.EM_X86_64, "firmware=fb/*.bin", "firmware=none.bin")
+	var ax bytes.Buffer
+	w, err := xz.NewWriter(&ax)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(a); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bz := enc.EncodeAll(b, nil)
+	enc.Close()
+
+	mods, fw := t.TempDir(), t.TempDir()
+	for n, dat := range map[string][]byte{
+		mods + "/modules.dep":     []byte("kernel/a.ko.xz: kernel/b.ko.zst\nkernel/b.ko.zst:\nkernel/c.ko:\n"),
+		mods + "/kernel/a.ko.xz":  ax.Bytes(),
+		mods + "/kernel/b.ko.zst": bz,
+		mods + "/kernel/c.ko":     testModule(elf.EM_AARCH64),
+		fw + "/fa.bin.zst":        []byte("fa"),
+		fw + "/fb/x.bin.xz":       []byte("x"),
+		fw + "/fb/y.bin":          []byte("y"),
+		fw + "/unused.bin":        []byte("unused"),
+	} {
+		if err := os.MkdirAll(filepath.Dir(n), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(n, dat, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bl := &Builder{Options: Options{OS: "linux", Arch: "amd64", KernelModules: mods, KModules: []string{"a"}, Firmware: fw}, bin: "linux_amd64/bin", img: newOverlay(t.TempDir(), time.Time{})}
+	if err := bl.kmods(); err != nil {
+		t.Fatal(err)
+	}
+	for n, want := range map[string]string{
+		"linux_amd64/lib/modules/modules.load": "b.ko\na.ko\n",
+		"linux_amd64/lib/modules/a.ko":         string(a),
+		"linux_amd64/lib/modules/b.ko":         string(b),
+	} {
+		if got, err := readFile(bl.img, n); err != nil || got != want {
+			t.Errorf("%q: got %q, %v, want %q, nil", n, got, err, want)
+		}
+	}
+	var got []string
+	for n := range bl.img.gen {
+		if strings.HasPrefix(n, "lib/firmware/") && bl.img.gen[n].host != "" {
+			got = append(got, n)
+		}
+	}
+	sort.Strings(got)
+	if want := []string{"lib/firmware/fa.bin.zst", "lib/firmware/fb/x.bin.xz", "lib/firmware/fb/y.bin"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("firmware: got %q, want %q", got, want)
+	}
+
+	bl = &Builder{Options: Options{OS: "linux", Arch: "amd64", KernelModules: mods, KModules: []string{"c"}}, bin: "linux_amd64/bin", img: newOverlay(t.TempDir(), time.Time{})}
+	if err := bl.kmods(); err == nil {
+		t.Errorf("a module for another machine: got nil, want error")
+	}
+}
@@ -0,0 +1,19 @@
+// Copyright 2022 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !freebsd && !linux
+// +build !freebsd,!linux
+
+package builder
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// sharedLibs returns an error: ELF shared libraries can only be found
+// on ELF hosts.
+func sharedLibs(bins []string) ([]string, error) {
+	return nil, fmt.Errorf("not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,16 @@
+// Copyright 2022 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build freebsd || linux
+// +build freebsd linux
+
+package builder
+
+import "github.com/u-root/u-root/pkg/ldd"
+
+// sharedLibs returns the paths of the files in bins, the shared
+// libraries they need, their interpreters, and the symlinks to them.
+func sharedLibs(bins []string) ([]string, error) {
+	return ldd.List(bins)
+}
@@ -0,0 +1,169 @@
+// Copyright 2022 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package builder
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// Commands may also be named by package path and version, e.g.
+// golang.org/x/tools/cmd/stringer@v0.1.12, and downloaded through a
+// GOPROXY, which may be a file:// directory for offline builds, rather
+// than cloned. Each is got in its own scratch module, hidden in the
+// state directory, so that they do not change each other's
+// dependencies. Their sources, and their dependencies, stay in the
+// module cache, which is in the tree, and their stubs point there.
+// Every go command shares that cache, /src/pkg/mod in the image, which
+// is where installcommand builds from.
+
+// modulesDir is where the scratch modules are, in the workspace.
+var modulesDir = filepath.Join(stateDir, "modules")
+
+// checkModules returns an error for modules that are not path@version.
+func checkModules(mods []string) error {
+	for _, m := range mods {
+		if p, v, ok := strings.Cut(m, "@"); !ok || p == "" || v == "" {
+			return fmt.Errorf("module %q: want path@version", m)
+		}
+	}
+	return nil
+}
+
+// scratchModule returns the directory of the scratch module for m.
+func (b *Builder) scratchModule(m string) string {
+	return filepath.Join(b.Workspace, modulesDir, strings.NewReplacer("/", "_", "@", "_").Replace(m))
+}
+
+// goPath is the GOPATH of every go command, so that the module cache
+// is src/pkg/mod in the workspace.
+func (b *Builder) goPath() string {
+	return filepath.Join(b.Workspace, "src")
+}
+
+// goPathEnv returns the environment for goPath, overriding any
+// GOMODCACHE of the caller's.
+func (b *Builder) goPathEnv() []string {
+	return []string{"GOPATH=" + b.goPath(), "GOMODCACHE=" + filepath.Join(b.goPath(), "pkg", "mod")}
+}
+
+// goCmd returns a go command to run in dir, with the module cache in the
+// workspace, and GOPROXY, if set.
+func (b *Builder) goCmd(ctx context.Context, dir string, args ...string) *exec.Cmd {
+	c := exec.CommandContext(ctx, filepath.Join(b.Workspace, "go/bin/go"), args...)
+	c.Dir = dir
+	c.Stderr = os.Stderr
+	c.Env = append(append(os.Environ(), b.goPathEnv()...), "GOFLAGS=-mod=mod")
+	c.Env = append(c.Env, b.goEnv()...)
+	if b.GOPROXY != "" {
+		c.Env = append(c.Env, "GOPROXY="+b.GOPROXY)
+		// A proxy directory has no checksum database.
+		if _, ok := os.LookupEnv("GOSUMDB"); !ok && strings.HasPrefix(b.GOPROXY, "file://") {
+			c.Env = append(c.Env, "GOSUMDB=off")
+		}
+	}
+	return c
+}
+
+// getModule downloads package m, path@version, and its dependencies
+// into the module cache.
+func (b *Builder) getModule(ctx context.Context, m string) error {
+	d := b.scratchModule(m)
+	if err := os.MkdirAll(d, 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(d, "go.mod"), []byte("module sourcery.local/modules\n"), 0644); err != nil {
+		return err
+	}
+	os.Remove(filepath.Join(d, "go.sum"))
+	c := b.goCmd(ctx, d, "get", "-d", m)
+	c.Stdout = os.Stdout
+	V("Run %q in %q", c.Args, c.Dir)
+	if err := c.Run(); err != nil {
+		return err
+	}
+	// installcommand builds it in its own module, which may need
+	// more than this one does.
+	dir, err := b.moduleDir(ctx, m)
+	if err != nil {
+		return err
+	}
+	c = b.goCmd(ctx, dir, "mod", "download")
+	V("Run %q in %q", c.Args, c.Dir)
+	return c.Run()
+}
+
+// moduleDir returns the directory of package m, path@version, in the
+// module cache. It must have been got.
+func (b *Builder) moduleDir(ctx context.Context, m string) (string, error) {
+	p, _, _ := strings.Cut(m, "@")
+	var out bytes.Buffer
+	c := b.goCmd(ctx, b.scratchModule(m), "list", "-f", "{{.Dir}}", p)
+	c.Stdout = &out
+	if err := c.Run(); err != nil {
+		return "", fmt.Errorf("go list %q: %v", p, err)
+	}
+	return strings.TrimSpace(out.String()), nil
+}
+
+var majorVersion = regexp.MustCompile(`^v[0-9]+$`)
+
+// moduleCommand returns the name of the command in package p, which,
+// as go install does, skips a major version suffix.
+func moduleCommand(p string) string {
+	n := path.Base(p)
+	if majorVersion.MatchString(n) && path.Dir(p) != "." {
+		n = path.Base(path.Dir(p))
+	}
+	return n
+}
+
+// modules downloads each of the modules, each in a module phase.
+func (b *Builder) modules(ctx context.Context) error {
+	var err error
+	for _, m := range b.Modules {
+		if e := b.phase(ctx, "module "+m, b.scratchModule(m), func() error {
+			return b.getModule(ctx, m)
+		}); e != nil {
+			err = multierror.Append(err, e)
+		}
+	}
+	return err
+}
+
+// moduleStubs adds a stub to the image for each of the modules that is
+// not prebuilt.
+func (b *Builder) moduleStubs(ctx context.Context) error {
+	var err error
+	skip := b.prebuilt()
+	for _, m := range b.Modules {
+		p, _, _ := strings.Cut(m, "@")
+		if skip[moduleCommand(p)] {
+			continue
+		}
+		dir, e := b.moduleDir(ctx, m)
+		if e == nil {
+			dir, e = filepath.Rel(b.Workspace, dir)
+		}
+		if e != nil {
+			err = multierror.Append(err, fmt.Errorf("%q: %v", m, e))
+			continue
+		}
+		f := path.Join(b.bin, moduleCommand(p))
+		dat := []byte("#!/" + b.bin + "/installcommand #!/" + filepath.ToSlash(dir) + "\n")
+		V("Write %q with %q", f, dat)
+		b.img.WriteFile(f, dat, 0755)
+	}
+	return err
+}
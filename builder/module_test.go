@@ -0,0 +1,133 @@
+// Copyright 2022 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package builder
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// hash1 returns the go.sum hash of files, which map names to contents.
+func hash1(files map[string]string) string {
+	var names []string
+	for n := range files {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	h := sha256.New()
+	for _, n := range names {
+		fmt.Fprintf(h, "%x  %s\n", sha256.Sum256([]byte(files[n])), n)
+	}
+	return "h1:" + base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// goSum returns the go.sum lines for module m, path@version, with files.
+func goSum(m string, files map[string]string) string {
+	p, v, _ := strings.Cut(m, "@")
+	zipped := map[string]string{}
+	for n, s := range files {
+		zipped[m+"/"+n] = s
+	}
+	return fmt.Sprintf("%s %s %s\n%s %s/go.mod %s\n", p, v, hash1(zipped), p, v, hash1(map[string]string{"go.mod": files["go.mod"]}))
+}
+
+// writeProxy returns a GOPROXY directory serving mods, which map
+// path@version to the module's files.
+func writeProxy(t *testing.T, mods map[string]map[string]string) string {
+	t.Helper()
+	d := t.TempDir()
+	for m, files := range mods {
+		p, v, _ := strings.Cut(m, "@")
+		at := filepath.Join(d, p, "@v")
+		if err := os.MkdirAll(at, 0755); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Create(filepath.Join(at, v+".zip"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		zw := zip.NewWriter(f)
+		for n, s := range files {
+			w, err := zw.Create(m + "/" + n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.Write([]byte(s)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+		for n, s := range map[string]string{
+			"list":      v + "\n",
+			v + ".info": `{"Version":"` + v + `","Time":"2022-01-01T00:00:00Z"}`,
+			v + ".mod":  files["go.mod"],
+		} {
+			if err := os.WriteFile(filepath.Join(at, n), []byte(s), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return d
+}
+
+// testProxy returns a GOPROXY directory with example.com/tool, whose
+// command, cmd/tool, imports example.com/dep.
+func testProxy(t *testing.T) string {
+	t.Helper()
+	dep := map[string]string{
+		"go.mod": "module example.com/dep\n\ngo 1.17\n",
+		"dep.go": "package dep\n\nconst S = \"dep\"\n",
+	}
+	return writeProxy(t, map[string]map[string]string{
+		"example.com/dep@v1.0.0": dep,
+		"example.com/tool@v1.0.0": {
+			"go.mod":           "module example.com/tool\n\ngo 1.17\n\nrequire example.com/dep v1.0.0\n",
+			"go.sum":           goSum("example.com/dep@v1.0.0", dep),
+			"cmd/tool/main.go": "package main\n\nimport \"example.com/dep\"\n\nfunc main() { println(dep.S) }\n",
+		},
+	})
+}
+
+func TestGetModule(t *testing.T) {
+	// The proxy has no checksum database.
+	t.Setenv("GOSUMDB", "off")
+	// Not where the image's module cache is.
+	t.Setenv("GOMODCACHE", t.TempDir())
+	d := testWorkspace(t)
+	b := &Builder{Options: Options{Workspace: d, OS: runtime.GOOS, Arch: runtime.GOARCH, GOPROXY: "file://" + testProxy(t)}}
+	m := "example.com/tool/cmd/tool@v1.0.0"
+	if err := b.getModule(context.Background(), m); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := b.moduleDir(context.Background(), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(d, "src/pkg/mod/example.com/tool@v1.0.0/cmd/tool"); dir != want {
+		t.Errorf("moduleDir(%q): got %q, want %q", m, dir, want)
+	}
+	// As installcommand does, offline.
+	c := exec.Command(filepath.Join(d, "go/bin/go"), "build", "-o", filepath.Join(t.TempDir(), "tool"))
+	c.Dir = dir
+	c.Env = append(os.Environ(), "GOPATH="+filepath.Join(d, "src"), "GOMODCACHE=", "GOPROXY=off", "GOFLAGS=-mod=readonly", "CGO_ENABLED=0")
+	if out, err := c.CombinedOutput(); err != nil {
+		t.Fatalf("go build in %q: %v: %s", dir, err, out)
+	}
+}
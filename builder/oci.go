@@ -0,0 +1,315 @@
+// Copyright 2022 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package builder
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// This file writes an OCI image layout directory, which podman, docker
+// (via skopeo) and friends can run directly:
+//	podman run --privileged oci:/path/to/layout:latest
+// The layers are plain gzipped tarballs. When split, the toolchain,
+// the sources and module cache, and everything else each get their own
+// layer, so rebuilding with a new repo does not change the toolchain
+// layer, and caches keep it.
+
+const (
+	ociManifestType = "application/vnd.oci.image.manifest.v1+json"
+	ociConfigType   = "application/vnd.oci.image.config.v1+json"
+	ociLayerType    = "application/vnd.oci.image.layer.v1.tar+gzip"
+	ociRefName      = "org.opencontainers.image.ref.name"
+)
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Config        ociDescriptor   `json:"config"`
+	Layers        []ociDescriptor `json:"layers"`
+}
+
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+type ociHistory struct {
+	Created   time.Time `json:"created"`
+	CreatedBy string    `json:"created_by"`
+}
+
+type ociConfig struct {
+	Created      time.Time `json:"created"`
+	Architecture string    `json:"architecture"`
+	OS           string    `json:"os"`
+	Config       struct {
+		Entrypoint []string `json:"Entrypoint"`
+		WorkingDir string   `json:"WorkingDir"`
+	} `json:"config"`
+	RootFS struct {
+		Type    string   `json:"type"`
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+	History []ociHistory `json:"history"`
+}
+
+// ociLayer names a layer and the top level directories that go in it.
+// A layer with no directories gets everything the others do not.
+type ociLayer struct {
+	name string
+	dirs []string
+}
+
+var ociSplit = []ociLayer{
+	{name: "toolchain", dirs: []string{"go"}},
+	{name: "sources", dirs: []string{"src"}},
+	{name: "bin"},
+}
+
+// layerOf returns the index in layers of the layer holding p.
+func layerOf(layers []ociLayer, p string) int {
+	top := strings.SplitN(p, "/", 2)[0]
+	rest := -1
+	for i, l := range layers {
+		if len(l.dirs) == 0 {
+			rest = i
+		}
+		for _, d := range l.dirs {
+			if d == top {
+				return i
+			}
+		}
+	}
+	return rest
+}
+
+// blobWriter writes a blob into the layout, naming it by its digest
+// when it is done.
+type blobWriter struct {
+	dir  string
+	f    *os.File
+	h    hash.Hash
+	size int64
+}
+
+func newBlob(dir string) (*blobWriter, error) {
+	f, err := os.CreateTemp(dir, "blob")
+	if err != nil {
+		return nil, err
+	}
+	return &blobWriter{dir: dir, f: f, h: sha256.New()}, nil
+}
+
+func (b *blobWriter) Write(p []byte) (int, error) {
+	n, err := b.f.Write(p)
+	b.h.Write(p[:n])
+	b.size += int64(n)
+	return n, err
+}
+
+// commit closes the blob and returns its descriptor.
+func (b *blobWriter) commit(mediaType string) (ociDescriptor, error) {
+	if err := b.f.Close(); err != nil {
+		return ociDescriptor{}, err
+	}
+	sum := fmt.Sprintf("%x", b.h.Sum(nil))
+	if err := os.Rename(b.f.Name(), filepath.Join(b.dir, sum)); err != nil {
+		return ociDescriptor{}, err
+	}
+	return ociDescriptor{MediaType: mediaType, Digest: "sha256:" + sum, Size: b.size}, nil
+}
+
+func writeBlob(dir, mediaType string, v interface{}) (ociDescriptor, error) {
+	dat, err := json.Marshal(v)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	b, err := newBlob(dir)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	if _, err := b.Write(dat); err != nil {
+		return ociDescriptor{}, err
+	}
+	return b.commit(mediaType)
+}
+
+// layerWriter writes a gzipped tarball blob.
+type layerWriter struct {
+	b    *blobWriter
+	zw   *gzip.Writer
+	diff hash.Hash
+	tw   *tar.Writer
+}
+
+func newLayer(dir string) (*layerWriter, error) {
+	b, err := newBlob(dir)
+	if err != nil {
+		return nil, err
+	}
+	l := &layerWriter{b: b, zw: gzip.NewWriter(b), diff: sha256.New()}
+	l.tw = tar.NewWriter(io.MultiWriter(l.zw, l.diff))
+	return l, nil
+}
+
+// add writes p, from fsys, to the tarball.
+func (l *layerWriter) add(fsys fs.FS, p string, d fs.DirEntry) error {
+	fi, err := d.Info()
+	if err != nil {
+		return err
+	}
+	var link string
+	if d.Type()&fs.ModeSymlink != 0 {
+		if link, err = readLink(fsys, p); err != nil {
+			return err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		V("oci: skipping %q: %v", p, err)
+		return nil
+	}
+	// Everything in the image belongs to root, and only
+	// the contents and modification times matter.
+	hdr.Name = p
+	if d.IsDir() {
+		hdr.Name += "/"
+	}
+	hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname = 0, 0, "", ""
+	hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+	if err := l.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil
+	}
+	f, err := fsys.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(l.tw, f)
+	return err
+}
+
+// commit finishes the tarball and returns the blob's descriptor and
+// the digest of the uncompressed tarball, which the config calls the
+// diff ID.
+func (l *layerWriter) commit() (ociDescriptor, string, error) {
+	if err := l.tw.Close(); err != nil {
+		return ociDescriptor{}, "", err
+	}
+	if err := l.zw.Close(); err != nil {
+		return ociDescriptor{}, "", err
+	}
+	desc, err := l.b.commit(ociLayerType)
+	return desc, fmt.Sprintf("sha256:%x", l.diff.Sum(nil)), err
+}
+
+// tarLayers writes fsys as gzipped tarball blobs, one per layer, in a
+// single walk, each file going to the layer that holds it.
+func tarLayers(fsys fs.FS, dir string, layers []ociLayer) ([]ociDescriptor, []string, error) {
+	var ws []*layerWriter
+	defer func() {
+		for _, l := range ws {
+			l.b.f.Close()
+			os.Remove(l.b.f.Name())
+		}
+	}()
+	for range layers {
+		l, err := newLayer(dir)
+		if err != nil {
+			return nil, nil, err
+		}
+		ws = append(ws, l)
+	}
+	if err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == "." {
+			return err
+		}
+		return ws[layerOf(layers, p)].add(fsys, p, d)
+	}); err != nil {
+		return nil, nil, err
+	}
+	var (
+		descs   []ociDescriptor
+		diffIDs []string
+	)
+	for i, l := range ws {
+		desc, diffID, err := l.commit()
+		if err != nil {
+			return nil, nil, fmt.Errorf("layer %q: %v", layers[i].name, err)
+		}
+		descs, diffIDs = append(descs, desc), append(diffIDs, diffID)
+	}
+	return descs, diffIDs, nil
+}
+
+// oci writes an OCI image layout of fsys to out. The image runs
+// the sourcery init for kern and arch in test mode. If split, the
+// image has a layer for each of ociSplit.
+func oci(fsys fs.FS, out, kern, arch string, split bool) error {
+	blobs := filepath.Join(out, "blobs", "sha256")
+	if err := os.MkdirAll(blobs, 0755); err != nil {
+		return err
+	}
+	layers := []ociLayer{{name: "all"}}
+	if split {
+		layers = ociSplit
+	}
+	fi, err := fs.Stat(fsys, ".")
+	if err != nil {
+		return err
+	}
+	created := fi.ModTime().UTC()
+
+	var c ociConfig
+	c.Created, c.Architecture, c.OS = created, arch, kern
+	c.Config.Entrypoint = []string{path.Join("/", fmt.Sprintf("%s_%s", kern, arch), "bin", "init"), "-test"}
+	c.Config.WorkingDir = "/"
+	c.RootFS.Type = "layers"
+	m := ociManifest{SchemaVersion: 2, MediaType: ociManifestType}
+	if m.Layers, c.RootFS.DiffIDs, err = tarLayers(fsys, blobs, layers); err != nil {
+		return err
+	}
+	for _, l := range layers {
+		c.History = append(c.History, ociHistory{Created: created, CreatedBy: "sourcery " + l.name})
+	}
+	if m.Config, err = writeBlob(blobs, ociConfigType, c); err != nil {
+		return err
+	}
+	md, err := writeBlob(blobs, ociManifestType, m)
+	if err != nil {
+		return err
+	}
+	md.Annotations = map[string]string{ociRefName: "latest"}
+	idx, err := json.Marshal(ociIndex{SchemaVersion: 2, Manifests: []ociDescriptor{md}})
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(out, "index.json"), idx, 0644); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(out, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644)
+}
@@ -0,0 +1,106 @@
+// Copyright 2022 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package builder
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// readBlob returns the blob for desc in the layout at out, checking
+// its digest and size.
+func readBlob(t *testing.T, out string, desc ociDescriptor) []byte {
+	t.Helper()
+	dat, err := os.ReadFile(filepath.Join(out, "blobs", "sha256", strings.TrimPrefix(desc.Digest, "sha256:")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := fmt.Sprintf("sha256:%x", sha256.Sum256(dat)); d != desc.Digest || int64(len(dat)) != desc.Size {
+		t.Fatalf("blob %q: got digest %q, size %d, want size %d", desc.Digest, d, len(dat), desc.Size)
+	}
+	return dat
+}
+
+func TestOCI(t *testing.T) {
+	fsys := fstest.MapFS{
+		"go/bin/go":            {Data: []byte("go"), Mode: 0755},
+		"src/x/y.go":           {Data: []byte("package y"), Mode: 0644},
+		"linux_amd64/bin/init": {Data: []byte("init"), Mode: 0755},
+		"etc/hosts":            {Data: []byte("hosts"), Mode: 0644},
+	}
+	out := t.TempDir()
+	if err := oci(fsys, out, "linux", "amd64", true); err != nil {
+		t.Fatal(err)
+	}
+	dat, err := os.ReadFile(filepath.Join(out, "index.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var idx ociIndex
+	if err := json.Unmarshal(dat, &idx); err != nil {
+		t.Fatal(err)
+	}
+	if len(idx.Manifests) != 1 || idx.Manifests[0].MediaType != ociManifestType {
+		t.Fatalf("index.json: got %+v, want one manifest", idx.Manifests)
+	}
+	var m ociManifest
+	if err := json.Unmarshal(readBlob(t, out, idx.Manifests[0]), &m); err != nil {
+		t.Fatal(err)
+	}
+	var c ociConfig
+	if err := json.Unmarshal(readBlob(t, out, m.Config), &c); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"/linux_amd64/bin/init", "-test"}; !reflect.DeepEqual(c.Config.Entrypoint, want) {
+		t.Errorf("entrypoint: got %q, want %q", c.Config.Entrypoint, want)
+	}
+	if len(m.Layers) != len(ociSplit) || len(c.RootFS.DiffIDs) != len(ociSplit) {
+		t.Fatalf("got %d layers, %d diff_ids, want %d", len(m.Layers), len(c.RootFS.DiffIDs), len(ociSplit))
+	}
+	want := [][]string{
+		{"go/", "go/bin/", "go/bin/go"},
+		{"src/", "src/x/", "src/x/y.go"},
+		{"etc/", "etc/hosts", "linux_amd64/", "linux_amd64/bin/", "linux_amd64/bin/init"},
+	}
+	for i, l := range m.Layers {
+		zr, err := gzip.NewReader(bytes.NewReader(readBlob(t, out, l)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tarball, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := fmt.Sprintf("sha256:%x", sha256.Sum256(tarball)); d != c.RootFS.DiffIDs[i] {
+			t.Errorf("layer %d: got diff_id %q, want %q", i, c.RootFS.DiffIDs[i], d)
+		}
+		var names []string
+		tr := tar.NewReader(bytes.NewReader(tarball))
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			names = append(names, hdr.Name)
+		}
+		if !reflect.DeepEqual(names, want[i]) {
+			t.Errorf("layer %q: got %q, want %q", ociSplit[i].name, names, want[i])
+		}
+	}
+}
@@ -0,0 +1,461 @@
+// Copyright 2022 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package builder
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The image tree is an overlay. The bottom layer is the workspace on
+// disk: the toolchain, the clones and module cache, and the binaries
+// we build, all of which the Go tools need to have on disk anyway.
+// On top of that are files generated in memory, such as the command
+// stubs and boot configurations, and files copied from the build
+// machine, such as kernels, which are only read when an output is
+// written. The cpio, VFAT, ISO and OCI writers all stream from the
+// overlay; a tree on disk is just one more output.
+
+// genFile is a file in the generated layer of an overlay.
+type genFile struct {
+	data   []byte
+	host   string // if set, the contents come from this file instead
+	target string // if set, this is a symlink
+	mode   fs.FileMode
+	pinned bool // from an overlay directory; generated files do not replace it
+}
+
+// modeBits are the mode bits kept for generated files.
+const modeBits = fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky
+
+// overlay is an fs.FS of generated files on top of a directory on disk.
+type overlay struct {
+	root  string
+	disk  fs.FS
+	mtime time.Time
+	gen   map[string]*genFile
+	// clamp is true if files on disk newer than mtime get mtime.
+	clamp bool
+}
+
+// newOverlay returns an overlay on root. Generated files get epoch,
+// and files on disk newer than it get it, too, so builds can be
+// reproduced; with a zero epoch, generated files get now.
+func newOverlay(root string, epoch time.Time) *overlay {
+	o := &overlay{root: root, disk: os.DirFS(root), mtime: epoch, clamp: !epoch.IsZero(), gen: map[string]*genFile{}}
+	if !o.clamp {
+		o.mtime = time.Now()
+	}
+	return o
+}
+
+// clampInfo and clampEntry give files on disk the build time, if they
+// are newer, as reproducible builds do with SOURCE_DATE_EPOCH.
+type clampInfo struct {
+	fs.FileInfo
+	mtime time.Time
+}
+
+func (i clampInfo) ModTime() time.Time { return i.mtime }
+
+type clampEntry struct {
+	fs.DirEntry
+	o *overlay
+}
+
+func (e clampEntry) Info() (fs.FileInfo, error) {
+	fi, err := e.DirEntry.Info()
+	if err != nil {
+		return nil, err
+	}
+	return e.o.clampInfo(fi), nil
+}
+
+func (o *overlay) clampInfo(fi fs.FileInfo) fs.FileInfo {
+	if o.clamp && fi.ModTime().After(o.mtime) {
+		return clampInfo{FileInfo: fi, mtime: o.mtime}
+	}
+	return fi
+}
+
+func (o *overlay) add(name string, g *genFile) {
+	name = path.Clean(name)
+	if old, ok := o.gen[name]; ok && old.pinned && !g.pinned {
+		V("overlay: keep %q from an overlay directory", name)
+		return
+	}
+	o.gen[name] = g
+	for d := path.Dir(name); d != "."; d = path.Dir(d) {
+		if _, ok := o.gen[d]; ok {
+			break
+		}
+		o.gen[d] = &genFile{mode: fs.ModeDir | 0755}
+	}
+}
+
+// WriteFile adds a file with contents dat to the overlay.
+func (o *overlay) WriteFile(name string, dat []byte, mode fs.FileMode) {
+	o.add(name, &genFile{data: dat, mode: mode & modeBits})
+}
+
+// CopyFile adds a file whose contents are those of host to the overlay.
+func (o *overlay) CopyFile(name, host string, mode fs.FileMode) {
+	o.add(name, &genFile{host: host, mode: mode & modeBits})
+}
+
+// Symlink adds a symlink to target to the overlay.
+func (o *overlay) Symlink(target, name string) {
+	o.add(name, &genFile{target: target, mode: fs.ModeSymlink | 0777})
+}
+
+// Mkdir adds a directory to the overlay.
+func (o *overlay) Mkdir(name string, mode fs.FileMode) {
+	o.add(name, &genFile{mode: fs.ModeDir | mode&modeBits})
+}
+
+// AddDir adds the files in the directory host to the overlay under
+// dest, keeping their modes. They replace generated files, and
+// generated files do not replace them.
+func (o *overlay) AddDir(host, dest string) error {
+	return filepath.WalkDir(host, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		r, err := filepath.Rel(host, p)
+		if err != nil {
+			return err
+		}
+		name := path.Join(dest, filepath.ToSlash(r))
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		var g *genFile
+		switch {
+		case fi.IsDir():
+			if name == "." {
+				return nil
+			}
+			g = &genFile{mode: fs.ModeDir | fi.Mode()&modeBits}
+		case fi.Mode()&fs.ModeSymlink != 0:
+			t, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			g = &genFile{target: t, mode: fs.ModeSymlink | 0777}
+		case fi.Mode().IsRegular():
+			g = &genFile{host: p, mode: fi.Mode() & modeBits}
+		default:
+			V("overlay: skipping %q, type %v", p, fi.Mode().Type())
+			return nil
+		}
+		V("overlay: %q from %q", name, p)
+		g.pinned = true
+		o.add(name, g)
+		return nil
+	})
+}
+
+// Remove removes name from the generated layer, uncovering whatever is
+// on disk. Files from overlay directories stay.
+func (o *overlay) Remove(name string) {
+	name = path.Clean(name)
+	if g, ok := o.gen[name]; ok && g.pinned {
+		V("overlay: keep %q from an overlay directory", name)
+		return
+	}
+	delete(o.gen, name)
+}
+
+// genInfo implements fs.FileInfo and fs.DirEntry for generated files.
+type genInfo struct {
+	name  string
+	size  int64
+	mode  fs.FileMode
+	mtime time.Time
+}
+
+func (i genInfo) Name() string               { return i.name }
+func (i genInfo) Size() int64                { return i.size }
+func (i genInfo) Mode() fs.FileMode          { return i.mode }
+func (i genInfo) ModTime() time.Time         { return i.mtime }
+func (i genInfo) IsDir() bool                { return i.mode.IsDir() }
+func (i genInfo) Sys() interface{}           { return nil }
+func (i genInfo) Type() fs.FileMode          { return i.mode.Type() }
+func (i genInfo) Info() (fs.FileInfo, error) { return i, nil }
+
+func (o *overlay) genStat(name string, g *genFile) (fs.FileInfo, error) {
+	i := genInfo{name: path.Base(name), size: int64(len(g.data)), mode: g.mode, mtime: o.mtime}
+	switch {
+	case g.host != "":
+		fi, err := os.Stat(g.host)
+		if err != nil {
+			return nil, err
+		}
+		i.size, i.mtime = fi.Size(), o.clampInfo(fi).ModTime()
+	case g.target != "":
+		i.size = int64(len(g.target))
+	}
+	return i, nil
+}
+
+// hidden returns true for workspace files that are not part of the
+// image.
+func hidden(name string) bool {
+	return name == stateDir || strings.HasPrefix(name, stateDir+"/")
+}
+
+// Stat implements fs.StatFS. Like os.DirFS's Stat, it follows symlinks
+// on disk; generated symlinks are not followed.
+func (o *overlay) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	if hidden(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	if g, ok := o.gen[name]; ok && !g.mode.IsDir() {
+		return o.genStat(name, g)
+	}
+	fi, err := fs.Stat(o.disk, name)
+	if err == nil {
+		return o.clampInfo(fi), nil
+	}
+	if g, ok := o.gen[name]; ok {
+		return o.genStat(name, g)
+	}
+	if name == "." {
+		return genInfo{name: ".", mode: fs.ModeDir | 0755, mtime: o.mtime}, nil
+	}
+	return nil, err
+}
+
+// ReadDir implements fs.ReadDirFS, merging generated and disk entries.
+func (o *overlay) ReadDir(name string) ([]fs.DirEntry, error) {
+	ents := map[string]fs.DirEntry{}
+	de, err := fs.ReadDir(o.disk, name)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, e := range de {
+		if !hidden(path.Join(name, e.Name())) {
+			ents[e.Name()] = clampEntry{DirEntry: e, o: o}
+		}
+	}
+	g, isGen := o.gen[name]
+	if err != nil && !isGen && name != "." {
+		return nil, err
+	}
+	if isGen && !g.mode.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fmt.Errorf("not a directory")}
+	}
+	for n, g := range o.gen {
+		if n == "." || path.Dir(n) != name {
+			continue
+		}
+		// Generated directories merge with directories on disk.
+		if e, ok := ents[path.Base(n)]; ok && e.IsDir() && g.mode.IsDir() {
+			continue
+		}
+		fi, err := o.genStat(n, g)
+		if err != nil {
+			return nil, err
+		}
+		ents[path.Base(n)] = fi.(genInfo)
+	}
+	var r []fs.DirEntry
+	for _, e := range ents {
+		r = append(r, e)
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].Name() < r[j].Name() })
+	return r, nil
+}
+
+// ReadLink implements fs.ReadLinkFS.
+func (o *overlay) ReadLink(name string) (string, error) {
+	if g, ok := o.gen[name]; ok {
+		if g.target == "" {
+			return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+		}
+		return g.target, nil
+	}
+	return os.Readlink(filepath.Join(o.root, filepath.FromSlash(name)))
+}
+
+// genReader is an open generated file.
+type genReader struct {
+	*bytes.Reader
+	info fs.FileInfo
+}
+
+func (g *genReader) Stat() (fs.FileInfo, error) { return g.info, nil }
+func (g *genReader) Close() error               { return nil }
+
+// hostFile is an open file from the build machine, that says it is
+// the file in the overlay.
+type hostFile struct {
+	*os.File
+	info fs.FileInfo
+}
+
+func (h *hostFile) Stat() (fs.FileInfo, error) { return h.info, nil }
+
+// genDir is an open directory.
+type genDir struct {
+	info fs.FileInfo
+	ents []fs.DirEntry
+}
+
+func (d *genDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *genDir) Read([]byte) (int, error)   { return 0, fmt.Errorf("%s: is a directory", d.info.Name()) }
+func (d *genDir) Close() error               { return nil }
+
+func (d *genDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if n <= 0 {
+		e := d.ents
+		d.ents = nil
+		return e, nil
+	}
+	if len(d.ents) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.ents) {
+		n = len(d.ents)
+	}
+	e := d.ents[:n]
+	d.ents = d.ents[n:]
+	return e, nil
+}
+
+// Open implements fs.FS.
+func (o *overlay) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if hidden(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	g, ok := o.gen[name]
+	if !ok || g.mode.IsDir() {
+		fi, err := o.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			return o.disk.Open(name)
+		}
+		ents, err := o.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+		return &genDir{info: fi, ents: ents}, nil
+	}
+	fi, err := o.genStat(name, g)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case g.host != "":
+		f, err := os.Open(g.host)
+		if err != nil {
+			return nil, err
+		}
+		return &hostFile{File: f, info: fi}, nil
+	case g.target != "":
+		return &genReader{Reader: bytes.NewReader([]byte(g.target)), info: fi}, nil
+	}
+	return &genReader{Reader: bytes.NewReader(g.data), info: fi}, nil
+}
+
+// materialize writes the generated layer into dir.
+func (o *overlay) materialize(dir string) error {
+	var names []string
+	for n := range o.gen {
+		names = append(names, n)
+	}
+	// Parents sort before their children.
+	sort.Strings(names)
+	for _, n := range names {
+		if err := o.writeOne(dir, n, o.gen[n]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *overlay) writeOne(dir, n string, g *genFile) error {
+	p := filepath.Join(dir, filepath.FromSlash(n))
+	switch {
+	case g.mode.IsDir():
+		return os.MkdirAll(p, g.mode.Perm())
+	case g.target != "":
+		os.Remove(p)
+		return os.Symlink(g.target, p)
+	}
+	f, err := o.Open(n)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return copyFile(p, f, g.mode&modeBits)
+}
+
+func copyFile(p string, r io.Reader, mode fs.FileMode) error {
+	w, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	// Neither the umask nor OpenFile's perm bits get this right.
+	return os.Chmod(p, mode)
+}
+
+// writeTree writes all of fsys into the directory dir.
+func writeTree(fsys fs.FS, dir string) error {
+	return fs.WalkDir(fsys, ".", func(n string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		p := filepath.Join(dir, filepath.FromSlash(n))
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(p, fi.Mode().Perm()|0700)
+		case d.Type()&fs.ModeSymlink != 0:
+			t, err := readLink(fsys, n)
+			if err != nil {
+				return err
+			}
+			os.Remove(p)
+			return os.Symlink(t, p)
+		case !fi.Mode().IsRegular():
+			V("tree: skipping %q, type %v", n, d.Type())
+			return nil
+		}
+		f, err := fsys.Open(n)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return copyFile(p, f, fi.Mode()&modeBits)
+	})
+}
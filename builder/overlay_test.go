@@ -0,0 +1,143 @@
+// Copyright 2022 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package builder
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/u-root/u-root/pkg/cpio"
+)
+
+func TestOverlay(t *testing.T) {
+	d := t.TempDir()
+	for n, dat := range map[string]string{
+		"go/VERSION":             "go1.17.7",
+		"linux_amd64/bin/ls":     "on disk",
+		"linux_amd64/bin/cat":    "on disk",
+		stateDir + "/state.json": "{}",
+	} {
+		p := filepath.Join(d, n)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(dat), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	img := newOverlay(d, time.Time{})
+	img.Mkdir("tmp", 0755)
+	img.WriteFile("linux_amd64/bin/ls", []byte("stub"), 0755)
+	img.WriteFile("etc/hostname", []byte("sourcery\n"), 0644)
+	img.Symlink("/linux_amd64/bin/init", "init")
+
+	if err := fstest.TestFS(img, "go/VERSION", "linux_amd64/bin/ls", "linux_amd64/bin/cat", "etc/hostname", "tmp", "init"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat(img, stateDir); err == nil {
+		t.Errorf("%q: got nil, want error", stateDir)
+	}
+	for n, want := range map[string]string{
+		"linux_amd64/bin/ls":  "stub",
+		"linux_amd64/bin/cat": "on disk",
+	} {
+		if got, err := readFile(img, n); err != nil || got != want {
+			t.Errorf("%q: got %q, %v, want %q, nil", n, got, err, want)
+		}
+	}
+
+	out := filepath.Join(t.TempDir(), "tree")
+	if err := writeTree(img, out); err != nil {
+		t.Fatal(err)
+	}
+	if l, err := os.Readlink(filepath.Join(out, "init")); err != nil || l != "/linux_amd64/bin/init" {
+		t.Errorf("init: got %q, %v, want %q, nil", l, err, "/linux_amd64/bin/init")
+	}
+
+	c := filepath.Join(t.TempDir(), "cpio")
+	if err := (&Builder{}).ramfs(img, c); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	recs, err := cpio.ReadAllRecords(cpio.Newc.Reader(f))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, r := range recs {
+		dat, err := io.ReadAll(io.NewSectionReader(r, 0, int64(r.FileSize)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[r.Name] = string(dat)
+	}
+	for n, want := range map[string]string{
+		"linux_amd64/bin/ls": "stub",
+		"go/VERSION":         "go1.17.7",
+		"init":               "/linux_amd64/bin/init",
+		"tmp":                "",
+	} {
+		if g, ok := got[n]; !ok || g != want {
+			t.Errorf("cpio %q: got %q, %v, want %q", n, g, ok, want)
+		}
+	}
+}
+
+func TestEpoch(t *testing.T) {
+	d := t.TempDir()
+	if err := os.WriteFile(filepath.Join(d, "new"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	epoch := time.Unix(1e9, 0)
+	img := newOverlay(d, epoch)
+	img.WriteFile("gen", nil, 0644)
+	for _, n := range []string{"new", "gen"} {
+		if fi, err := fs.Stat(img, n); err != nil || !fi.ModTime().Equal(epoch) {
+			t.Errorf("%q: got %v, want %v", n, fi, epoch)
+		}
+	}
+}
+
+func readFile(img *overlay, n string) (string, error) {
+	f, err := img.Open(n)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	dat, err := io.ReadAll(f)
+	return string(dat), err
+}
+
+func TestAddDir(t *testing.T) {
+	d := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(d, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(d, "etc/hosts"), []byte("mine\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	img := newOverlay(t.TempDir(), time.Time{})
+	img.WriteFile("x/etc/hosts", []byte("generated\n"), 0644)
+	if err := img.AddDir(d, "x"); err != nil {
+		t.Fatal(err)
+	}
+	img.WriteFile("x/etc/hosts", []byte("generated again\n"), 0644)
+	img.Remove("x/etc/hosts")
+	if dat, err := readFile(img, "x/etc/hosts"); err != nil || dat != "mine\n" {
+		t.Errorf("x/etc/hosts: got %q, %v, want %q, nil", dat, err, "mine\n")
+	}
+	if fi, err := img.Stat("x/etc/hosts"); err != nil || fi.Mode() != 0600 {
+		t.Errorf("x/etc/hosts mode: got %v, want %v", fi, fs.FileMode(0600))
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2022 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package builder
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Local fixes not yet upstream are carried as patches, applied to a
+// repo each time it is fetched, before modinit and tidy. Patches from
+// git format-patch are applied with git am, other diffs with git apply
+// and committed. Either way, the commits are made with fixed names and
+// dates, so that the same patches on the same upstream make the same
+// HEAD, and an unchanged repo stays up to date.
+
+// patchFiles returns the patch files in paths, each a file or a
+// directory of .patch and .diff files, applied in name order.
+func patchFiles(paths []string) ([]string, error) {
+	var files []string
+	for _, p := range paths {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			files = append(files, p)
+			continue
+		}
+		var m []string
+		for _, g := range []string{"*.patch", "*.diff"} {
+			f, err := filepath.Glob(filepath.Join(p, g))
+			if err != nil {
+				return nil, err
+			}
+			m = append(m, f...)
+		}
+		sort.Strings(m)
+		files = append(files, m...)
+	}
+	return files, nil
+}
+
+// isMbox returns true if the patch in file came from git format-patch.
+func isMbox(file string) (bool, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	l, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil && l == "" {
+		return false, fmt.Errorf("%q: empty patch", file)
+	}
+	return strings.HasPrefix(l, "From "), nil
+}
+
+// patch applies the patches for repo to its clone in dir, on top of
+// the upstream commit.
+func (b *Builder) patch(ctx context.Context, repo, dir string) error {
+	files, err := patchFiles(b.Patches[repo])
+	if err != nil {
+		return fmt.Errorf("patches for %q: %v", repo, err)
+	}
+	head, err := git(ctx, dir, "rev-parse", "HEAD")
+	if err != nil {
+		return err
+	}
+	upstream, err := git(ctx, dir, "rev-parse", "--verify", "-q", upstreamRef)
+	if err != nil {
+		// Cloned before there were patches.
+		if len(files) == 0 {
+			return nil
+		}
+		if _, err := git(ctx, dir, "update-ref", upstreamRef, head); err != nil {
+			return err
+		}
+		upstream = head
+	}
+	// Start over from upstream if there are patches now, or were
+	// the last time.
+	if len(files) == 0 && head == upstream {
+		return nil
+	}
+	if _, err := git(ctx, dir, "reset", "--hard", "-q", upstream); err != nil {
+		return err
+	}
+	date, err := git(ctx, dir, "log", "-1", "--format=%cI", upstream)
+	if err != nil {
+		return err
+	}
+	env := []string{
+		"GIT_AUTHOR_NAME=sourcery", "GIT_AUTHOR_EMAIL=sourcery@u-root.org", "GIT_AUTHOR_DATE=" + date,
+		"GIT_COMMITTER_NAME=sourcery", "GIT_COMMITTER_EMAIL=sourcery@u-root.org", "GIT_COMMITTER_DATE=" + date,
+	}
+	for _, f := range files {
+		abs, err := filepath.Abs(f)
+		if err != nil {
+			return err
+		}
+		mbox, err := isMbox(abs)
+		if err != nil {
+			return err
+		}
+		V("patch %q: apply %q", repo, f)
+		if mbox {
+			// git am keeps the patch's author; only the
+			// committer is ours.
+			_, err = gitEnv(ctx, dir, env, "am", "-q", "--committer-date-is-author-date", abs)
+			if err != nil {
+				gitEnv(ctx, dir, env, "am", "--abort")
+			}
+		} else {
+			if _, err = gitEnv(ctx, dir, env, "apply", "--index", abs); err == nil {
+				_, err = gitEnv(ctx, dir, env, "commit", "-q", "-m", "sourcery: apply "+filepath.Base(f))
+			}
+		}
+		if err != nil {
+			git(ctx, dir, "reset", "--hard", "-q", upstream)
+			return fmt.Errorf("patch %q no longer applies to %s at %s: %v", f, repo, upstream, err)
+		}
+	}
+	return nil
+}
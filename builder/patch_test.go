@@ -0,0 +1,85 @@
+// Copyright 2022 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package builder
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestPatch(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("no git")
+	}
+	ctx := context.Background()
+	env := []string{"GIT_AUTHOR_NAME=t", "GIT_AUTHOR_EMAIL=t@t", "GIT_COMMITTER_NAME=t", "GIT_COMMITTER_EMAIL=t@t"}
+	run := func(dir string, args ...string) string {
+		t.Helper()
+		out, err := gitEnv(ctx, dir, env, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+
+	// An upstream with one file, and a format-patch and a plain
+	// diff against it.
+	up := filepath.Join(t.TempDir(), "x")
+	run(filepath.Dir(up), "init", "-q", up)
+	if err := os.WriteFile(filepath.Join(up, "a"), []byte("a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	run(up, "add", "a")
+	run(up, "commit", "-q", "-m", "a")
+	if err := os.WriteFile(filepath.Join(up, "a"), []byte("a\nb\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	patches := t.TempDir()
+	run(up, "commit", "-q", "-a", "-m", "b")
+	run(up, "format-patch", "-q", "-1", "-o", patches)
+	if err := os.WriteFile(filepath.Join(up, "a"), []byte("a\nb\nc\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(patches, "0002-c.diff"), []byte(run(up, "diff")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	run(up, "checkout", "-q", "a")
+	run(up, "reset", "-q", "--hard", "HEAD~1")
+
+	repo := "file://" + up
+	b := &Builder{Options: Options{Patches: map[string][]string{repo: {patches}}}}
+	ws := t.TempDir()
+	var heads []string
+	for i := 0; i < 2; i++ {
+		if err := clone(ctx, ws, "", repo, "", "x"); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.patch(ctx, repo, filepath.Join(ws, "x")); err != nil {
+			t.Fatal(err)
+		}
+		heads = append(heads, run(filepath.Join(ws, "x"), "rev-parse", "HEAD"))
+	}
+	if heads[0] != heads[1] {
+		t.Errorf("patching twice: got HEADs %q, want the same", heads)
+	}
+	if dat, err := os.ReadFile(filepath.Join(ws, "x", "a")); err != nil || string(dat) != "a\nb\nc\n" {
+		t.Errorf("patched a: got %q, %v, want %q, nil", dat, err, "a\nb\nc\n")
+	}
+
+	// Upstream takes the first patch; it no longer applies.
+	if err := os.WriteFile(filepath.Join(up, "a"), []byte("a\nb\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	run(up, "commit", "-q", "-a", "-m", "b upstream")
+	if err := clone(ctx, ws, "", repo, "", "x"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.patch(ctx, repo, filepath.Join(ws, "x")); err == nil {
+		t.Errorf("patch that no longer applies: got nil, want error")
+	}
+}
@@ -0,0 +1,269 @@
+// Copyright 2022 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package builder
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// A Plan is what a build would do. Making one only reads the workspace,
+// if there is one; it does not touch the network or write anything.
+type Plan struct {
+	Version   string        `json:"version"`
+	OS        string        `json:"os"`
+	Arch      string        `json:"arch"`
+	Workspace string        `json:"workspace"` // empty for a new temporary directory
+	Phases    []PlanPhase   `json:"phases"`
+	Repos     []PlanRepo    `json:"repos"`
+	Commands  []string      `json:"commandPatterns"`
+	Stubs     []string      `json:"stubs"` // only known for repos already in the workspace
+	Tools     []string      `json:"tools"`
+	Kernels   []bootKernel  `json:"kernels,omitempty"`
+	KMods     []string      `json:"kernelModules,omitempty"` // in load order
+	Files     []PlanFile    `json:"files,omitempty"`
+	Sysroot   string        `json:"sysroot,omitempty"` // where the files' shared libraries are found
+	Overlays  []PlanOverlay `json:"overlays,omitempty"`
+	Outputs   []PlanOutput  `json:"outputs"`
+}
+
+// PlanPhase is a phase of the build.
+type PlanPhase struct {
+	Name string `json:"name"`
+	Skip bool   `json:"skip,omitempty"` // done, and resuming
+}
+
+// PlanRepo is a repo to be fetched.
+type PlanRepo struct {
+	URL     string   `json:"url"`
+	Path    string   `json:"path,omitempty"`   // in the workspace
+	Action  string   `json:"action,omitempty"` // clone or fetch
+	From    string   `json:"from,omitempty"`   // a mirror, if rewritten
+	Pin     string   `json:"pin,omitempty"`
+	Patches []string `json:"patches,omitempty"`
+	Err     string   `json:"error,omitempty"`
+}
+
+// PlanFile is a file or directory to be copied into the image.
+type PlanFile struct {
+	Host string `json:"host"`
+	Dest string `json:"dest"`
+}
+
+// PlanOverlay is a directory to be copied into the image.
+type PlanOverlay struct {
+	Dir  string `json:"dir"`
+	Dest string `json:"dest"`
+}
+
+// PlanOutput is an output to be written.
+type PlanOutput struct {
+	Kind string `json:"kind"`
+	Path string `json:"path"`
+}
+
+// Plan returns the plan for the build.
+func (b *Builder) Plan() (*Plan, error) {
+	d := b.Workspace
+	p := &Plan{Version: b.Version, OS: b.OS, Arch: b.Arch, Workspace: d, Commands: commandPatterns}
+	st := &state{}
+	if d != "" {
+		var err error
+		if st, err = loadState(d); err != nil {
+			return nil, err
+		}
+		st.resume = b.Resume && strings.Join(st.Args, " ") == strings.Join(b.args(), " ")
+	}
+	phase := func(n string) {
+		p.Phases = append(p.Phases, PlanPhase{Name: n, Skip: st.skip(n)})
+	}
+
+	phase("toolchain")
+	for _, u := range b.repos() {
+		r := PlanRepo{URL: u, Pin: b.Pins[u]}
+		if f := b.rewrite(u); f != u {
+			r.From = f
+		}
+		ps, err := patchFiles(b.Patches[u])
+		if err != nil {
+			return nil, err
+		}
+		r.Patches = ps
+		host, dir, base, err := goName(u)
+		if err != nil {
+			r.Err = err.Error()
+			p.Repos = append(p.Repos, r)
+			continue
+		}
+		r.Path, r.Action = filepath.Join(d, "src", host, dir, base), "clone"
+		if _, err := os.Stat(filepath.Join(r.Path, ".git")); d != "" && err == nil {
+			r.Action = "fetch"
+		}
+		p.Repos = append(p.Repos, r)
+		phase("fetch " + u)
+		phase("tidy " + u)
+	}
+	for _, m := range b.Modules {
+		phase("module " + m)
+	}
+	phase("stubs")
+	skip := b.prebuilt()
+	if d != "" {
+		for _, c := range commands(d) {
+			if !skip[filepath.Base(c)] {
+				p.Stubs = append(p.Stubs, path.Join(b.bin, filepath.Base(c)))
+			}
+		}
+	}
+	for _, m := range b.Modules {
+		mp, _, _ := strings.Cut(m, "@")
+		if !skip[moduleCommand(mp)] {
+			p.Stubs = append(p.Stubs, path.Join(b.bin, moduleCommand(mp)))
+		}
+	}
+	for _, t := range append(append([]string{}, buildTools...), b.Prebuild...) {
+		p.Tools = append(p.Tools, path.Join(b.bin, t))
+	}
+	phase("tools")
+
+	if len(b.Kernels) > 0 {
+		ks, err := b.kernels()
+		if err != nil {
+			return nil, err
+		}
+		p.Kernels = ks
+	}
+	kmods, err := b.kmodPaths()
+	if err != nil {
+		return nil, fmt.Errorf("kernel modules: %v", err)
+	}
+	for _, m := range kmods {
+		p.KMods = append(p.KMods, path.Join(b.kmodDir(), kmodName(m)+".ko"))
+	}
+	for _, f := range b.Files {
+		host, dest, err := splitFiles(f)
+		if err != nil {
+			return nil, err
+		}
+		p.Files = append(p.Files, PlanFile{Host: host, Dest: path.Join("/", dest)})
+	}
+	p.Sysroot = b.Sysroot
+	for _, o := range b.Overlays {
+		dir, dest := splitOverlay(o)
+		p.Overlays = append(p.Overlays, PlanOverlay{Dir: dir, Dest: path.Join("/", dest)})
+	}
+	t := b.Tree
+	if b.noOutputs() {
+		t = d
+		if t == "" {
+			t = "the workspace"
+		}
+	}
+	for _, o := range []PlanOutput{
+		{"cpio", b.CPIO},
+		{"vfat", b.VFAT},
+		{"iso", b.ISO},
+		{"oci", b.OCI},
+		{"sbom", b.SBOM},
+		{"tree", t},
+	} {
+		if o.Path != "" {
+			p.Outputs = append(p.Outputs, o)
+		}
+	}
+	phase("boot")
+	phase("archive")
+	return p, nil
+}
+
+// Print prints the plan to w, as JSON if asJSON.
+func (p *Plan) Print(w io.Writer, asJSON bool) error {
+	if asJSON {
+		e := json.NewEncoder(w)
+		e.SetIndent("", "\t")
+		return e.Encode(p)
+	}
+	ws := p.Workspace
+	if ws == "" {
+		ws = "a new temporary directory"
+	}
+	fmt.Fprintf(w, "Build %s_%s with %s in %s\n", p.OS, p.Arch, p.Version, ws)
+	fmt.Fprintf(w, "Phases:\n")
+	for _, ph := range p.Phases {
+		if ph.Skip {
+			fmt.Fprintf(w, "\t%s (done)\n", ph.Name)
+			continue
+		}
+		fmt.Fprintf(w, "\t%s\n", ph.Name)
+	}
+	fmt.Fprintf(w, "Repos:\n")
+	for _, r := range p.Repos {
+		if r.Err != "" {
+			fmt.Fprintf(w, "\t%s: %s\n", r.URL, r.Err)
+			continue
+		}
+		fmt.Fprintf(w, "\t%s %s into %s\n", r.Action, r.URL, r.Path)
+		if r.From != "" {
+			fmt.Fprintf(w, "\t\tfrom %s\n", r.From)
+		}
+		if r.Pin != "" {
+			fmt.Fprintf(w, "\t\tat %s\n", r.Pin)
+		}
+		for _, p := range r.Patches {
+			fmt.Fprintf(w, "\t\tpatch %s\n", p)
+		}
+	}
+	fmt.Fprintf(w, "Stubs:\n")
+	if len(p.Stubs) == 0 {
+		fmt.Fprintf(w, "\tone for each of %s\n", strings.Join(p.Commands, " "))
+	}
+	for _, s := range p.Stubs {
+		fmt.Fprintf(w, "\t%s\n", s)
+	}
+	fmt.Fprintf(w, "Tools:\n")
+	for _, t := range p.Tools {
+		fmt.Fprintf(w, "\t%s\n", t)
+	}
+	if len(p.Kernels) > 0 {
+		fmt.Fprintf(w, "Kernels:\n")
+		for _, k := range p.Kernels {
+			fmt.Fprintf(w, "\t%s: %s as %s, %s\n", k.Arch, k.Host, k.Path, k.Cmdline)
+			if k.Manager != "" {
+				fmt.Fprintf(w, "\t\tEFI boot manager %s\n", k.Manager)
+			}
+		}
+	}
+	if len(p.KMods) > 0 {
+		fmt.Fprintf(w, "Kernel modules:\n")
+		for _, m := range p.KMods {
+			fmt.Fprintf(w, "\t%s\n", m)
+		}
+	}
+	if len(p.Files) > 0 {
+		fmt.Fprintf(w, "Files:\n")
+		for _, f := range p.Files {
+			fmt.Fprintf(w, "\t%s into %s\n", f.Host, f.Dest)
+		}
+		if p.Sysroot != "" {
+			fmt.Fprintf(w, "\tshared libraries from %s\n", p.Sysroot)
+		}
+	}
+	if len(p.Overlays) > 0 {
+		fmt.Fprintf(w, "Overlays:\n")
+		for _, o := range p.Overlays {
+			fmt.Fprintf(w, "\t%s into %s\n", o.Dir, o.Dest)
+		}
+	}
+	fmt.Fprintf(w, "Outputs:\n")
+	for _, o := range p.Outputs {
+		fmt.Fprintf(w, "\t%s: %s\n", o.Kind, o.Path)
+	}
+	return nil
+}
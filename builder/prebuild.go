@@ -0,0 +1,91 @@
+// Copyright 2022 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package builder
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// Commands compile on first use, which is slow for the first ones a
+// boot runs, like the shell init starts. Prebuilt commands are
+// compiled, for the target, with the tools, into the bin directory, and
+// get no stubs. They are rebuilt every build; the Go build cache makes
+// that quick when nothing changed.
+
+// checkPrebuild returns an error for prebuilt commands that are not
+// names, or are tools.
+func checkPrebuild(names []string) error {
+	for _, n := range names {
+		if n == "" || strings.ContainsAny(n, `/\`) {
+			return fmt.Errorf("prebuild %q: want a command name", n)
+		}
+		for _, t := range buildTools {
+			if n == t {
+				return fmt.Errorf("prebuild %q: always built", n)
+			}
+		}
+	}
+	return nil
+}
+
+// prebuilt returns the names of the prebuilt commands.
+func (b *Builder) prebuilt() map[string]bool {
+	m := map[string]bool{}
+	for _, n := range b.Prebuild {
+		m[n] = true
+	}
+	return m
+}
+
+// commandDirs returns the directories of the commands in the workspace
+// and the modules, by name. The last command found by a name wins, as
+// its stub would.
+func (b *Builder) commandDirs(ctx context.Context) (map[string]string, error) {
+	dirs := map[string]string{}
+	for _, d := range commands(b.Workspace) {
+		dirs[filepath.Base(d)] = d
+	}
+	for _, m := range b.Modules {
+		d, err := b.moduleDir(ctx, m)
+		if err != nil {
+			return nil, err
+		}
+		p, _, _ := strings.Cut(m, "@")
+		dirs[moduleCommand(p)] = d
+	}
+	return dirs, nil
+}
+
+// prebuild compiles the prebuilt commands into the bin directory.
+func (b *Builder) prebuild(ctx context.Context) error {
+	if len(b.Prebuild) == 0 {
+		return nil
+	}
+	dirs, err := b.commandDirs(ctx)
+	if err != nil {
+		return err
+	}
+	for _, n := range b.Prebuild {
+		d, ok := dirs[n]
+		if !ok {
+			err = multierror.Append(err, fmt.Errorf("prebuild %q: no such command", n))
+			continue
+		}
+		bin := filepath.Join(b.Workspace, b.bin, n)
+		c := b.goCmd(ctx, d, "build", "-trimpath", "-o", bin)
+		// go.mod is as tidy left it, and the stubs build with it.
+		c.Env = append(c.Env, "GOFLAGS=-mod=readonly")
+		V("Prebuild %q in %q, install to %q", n, d, bin)
+		if e := c.Run(); e != nil {
+			err = multierror.Append(err, fmt.Errorf("prebuild %q: %v", n, e))
+		}
+	}
+	return err
+}
@@ -0,0 +1,66 @@
+// Copyright 2022 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package builder
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrebuild(t *testing.T) {
+	// The proxy has no checksum database.
+	t.Setenv("GOSUMDB", "off")
+	t.Setenv("GOMODCACHE", t.TempDir())
+	d := testWorkspace(t)
+	repo := filepath.Join(d, "src/github.com/u-root/u-root")
+	for n, s := range map[string]string{
+		"go.mod":                  "module github.com/u-root/u-root\n\ngo 1.17\n",
+		"cmds/core/hello/main.go": "package main\n\nimport \"example.com/dep\"\n\nfunc main() { println(dep.S) }\n",
+		"cmds/core/world/main.go": "package main\n\nfunc main() {}\n",
+	} {
+		p := filepath.Join(repo, n)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	arch := crossArch()
+	b := &Builder{Options: Options{Workspace: d, OS: "linux", Arch: arch, Prebuild: []string{"hello"}, GOPROXY: "file://" + testProxy(t)}, bin: "linux_" + arch + "/bin", img: newOverlay(d, time.Time{})}
+	// hello's dependency is got by tidy, as a fetched repo's is, and
+	// prebuilt offline.
+	if err := b.tidy(context.Background(), repo); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(d, "src/pkg/mod/example.com/dep@v1.0.0")); err != nil {
+		t.Fatalf("dependency not in the image's module cache: %v", err)
+	}
+	b.GOPROXY = "off"
+	if err := os.MkdirAll(filepath.Join(d, b.bin), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := files(d, b.bin, b.img, b.prebuilt()); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.prebuild(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	checkMachine(t, filepath.Join(d, b.bin, "hello"), arch)
+	for n, stub := range map[string]bool{"hello": false, "world": true} {
+		dat, err := readFile(b.img, path.Join(b.bin, n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.HasPrefix(dat, "#!"); got != stub {
+			t.Errorf("%q: got a stub %v, want %v", n, got, stub)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2022 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package builder
+
+import (
+	"context"
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The build report says how long each phase and repo took, how big
+// the results are, and whether they worked, for CI dashboards to track.
+// It is rewritten as each phase finishes, so a failed build still has
+// one.
+
+type reportPhase struct {
+	Name    string    `json:"name"`
+	Start   time.Time `json:"start"`
+	Seconds float64   `json:"seconds"`
+	Bytes   int64     `json:"bytes,omitempty"`
+	Result  string    `json:"result"` // ok, error or skipped
+	Err     string    `json:"error,omitempty"`
+}
+
+type reportRepo struct {
+	URL     string  `json:"url"`
+	Path    string  `json:"path"`
+	Commit  string  `json:"commit,omitempty"`
+	Seconds float64 `json:"seconds"`
+	Bytes   int64   `json:"bytes"`
+	Result  string  `json:"result"`
+	Err     string  `json:"error,omitempty"`
+}
+
+type reportOutput struct {
+	Kind  string `json:"kind"`
+	Path  string `json:"path"`
+	Bytes int64  `json:"bytes"`
+}
+
+type buildReport struct {
+	file      string
+	Version   string         `json:"version"`
+	OS        string         `json:"os"`
+	Arch      string         `json:"arch"`
+	Args      []string       `json:"args"`
+	Workspace string         `json:"workspace"`
+	Start     time.Time      `json:"start"`
+	Seconds   float64        `json:"seconds"`
+	Result    string         `json:"result"` // running, ok or error
+	Phases    []reportPhase  `json:"phases"`
+	Repos     []reportRepo   `json:"repos"`
+	Outputs   []reportOutput `json:"outputs"`
+	Chroot    string         `json:"chroot,omitempty"`
+}
+
+func newReport(file, d, version, kern, arch string, args []string) *buildReport {
+	return &buildReport{
+		file:      file,
+		Version:   version,
+		OS:        kern,
+		Arch:      arch,
+		Args:      args,
+		Workspace: d,
+		Start:     time.Now(),
+		Result:    "running",
+	}
+}
+
+// save writes the report. A nil report is not written.
+func (r *buildReport) save() error {
+	if r == nil {
+		return nil
+	}
+	r.Seconds = time.Since(r.Start).Seconds()
+	dat, err := json.MarshalIndent(r, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(r.file, dat, 0644)
+}
+
+// phase records phase name, which started at start, ending with err.
+func (r *buildReport) phase(name string, start time.Time, skipped bool, err error) error {
+	if r == nil {
+		return nil
+	}
+	p := reportPhase{Name: name, Start: start, Seconds: time.Since(start).Seconds(), Result: "ok"}
+	switch {
+	case skipped:
+		p.Result = "skipped"
+	case err != nil:
+		p.Result, p.Err = "error", err.Error()
+		r.Result = "error"
+	}
+	r.Phases = append(r.Phases, p)
+	return r.save()
+}
+
+// measure sets the size of the last phase name to the size of paths.
+func (r *buildReport) measure(name string, paths ...string) {
+	if r == nil {
+		return
+	}
+	for i := len(r.Phases) - 1; i >= 0; i-- {
+		if r.Phases[i].Name == name {
+			r.Phases[i].Bytes = du(paths...)
+			return
+		}
+	}
+}
+
+// repo records repo u, in dir, which took the phases fetch u and
+// tidy u.
+func (r *buildReport) repo(ctx context.Context, u, dir string, err error) {
+	if r == nil {
+		return
+	}
+	rr := reportRepo{URL: u, Path: dir, Bytes: du(dir), Result: "ok"}
+	if c, err := git(ctx, dir, "rev-parse", "HEAD"); err == nil {
+		rr.Commit = c
+	}
+	for _, p := range r.Phases {
+		if p.Name == "fetch "+u || p.Name == "tidy "+u {
+			rr.Seconds += p.Seconds
+		}
+	}
+	if err != nil {
+		rr.Result, rr.Err = "error", err.Error()
+	}
+	r.Repos = append(r.Repos, rr)
+}
+
+// output records an output of kind written to p.
+func (r *buildReport) output(kind, p string) {
+	if r == nil || p == "" {
+		return
+	}
+	r.Outputs = append(r.Outputs, reportOutput{Kind: kind, Path: p, Bytes: du(p)})
+}
+
+// du returns the total size of the regular files in paths.
+func du(paths ...string) int64 {
+	var n int64
+	for _, p := range paths {
+		filepath.WalkDir(p, func(_ string, d fs.DirEntry, err error) error {
+			if err != nil || !d.Type().IsRegular() {
+				return nil
+			}
+			if fi, err := d.Info(); err == nil {
+				n += fi.Size()
+			}
+			return nil
+		})
+	}
+	return n
+}
@@ -0,0 +1,242 @@
+// Copyright 2022 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package builder
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/u-root/u-root/pkg/cpio"
+)
+
+// To check that images are reproducible, Repro builds the same
+// configuration twice, in separate workspaces, and compares the trees
+// and the cpio archives. The second build is locked to the commits the
+// first one got, and both use the same SourceDateEpoch, so any
+// difference is the build's doing.
+
+// Lock returns the upstream commit of each repo in the workspace, for
+// Options.Pins.
+func (b *Builder) Lock(ctx context.Context) (map[string]string, error) {
+	pins := map[string]string{}
+	for _, u := range b.repos() {
+		host, dir, base, err := goName(u)
+		if err != nil {
+			return nil, err
+		}
+		d := filepath.Join(b.Workspace, "src", host, dir, base)
+		c, err := git(ctx, d, "rev-parse", "--verify", "-q", upstreamRef)
+		if err != nil {
+			if c, err = git(ctx, d, "rev-parse", "HEAD"); err != nil {
+				return nil, err
+			}
+		}
+		pins[u] = c
+	}
+	return pins, nil
+}
+
+// Repro builds o twice in dir, each build with its own workspace, tree
+// and cpio, and returns the differences between them. Outputs other
+// than the tree, cpio and SBOM are not written; the cpio is not
+// compressed, and has no early cpio.
+func Repro(ctx context.Context, o Options, dir string) ([]string, error) {
+	if o.SourceDateEpoch.IsZero() {
+		o.SourceDateEpoch = time.Unix(time.Now().Unix(), 0)
+		V("repro: SOURCE_DATE_EPOCH=%d", o.SourceDateEpoch.Unix())
+	}
+	var runs [2]Options
+	for i, n := range []string{"a", "b"} {
+		c := o
+		d := filepath.Join(dir, n)
+		c.Workspace, c.Tree, c.CPIO = filepath.Join(d, "workspace"), filepath.Join(d, "tree"), filepath.Join(d, "sourcery.cpio")
+		c.Compress, c.Early = "none", nil
+		c.VFAT, c.ISO, c.OCI, c.Report, c.Resume = "", "", "", "", false
+		if c.SBOM != "" {
+			c.SBOM = filepath.Join(d, "sbom")
+		}
+		if i == 1 {
+			c.Pins = runs[0].Pins
+		}
+		b, err := New(c)
+		if err != nil {
+			return nil, err
+		}
+		V("repro: build %s in %q", n, d)
+		if err := b.Build(ctx); err != nil {
+			return nil, fmt.Errorf("build %s: %v", n, err)
+		}
+		if i == 0 {
+			if c.Pins, err = b.Lock(ctx); err != nil {
+				return nil, err
+			}
+		}
+		runs[i] = c
+	}
+	diffs, err := diffTrees(runs[0].Tree, runs[1].Tree)
+	if err != nil {
+		return nil, err
+	}
+	d, err := diffCPIO(runs[0].CPIO, runs[1].CPIO)
+	return append(diffs, d...), err
+}
+
+// treeEntry is what is compared of a file in a tree.
+type treeEntry struct {
+	mode fs.FileMode
+	size int64
+	link string
+}
+
+// readTree returns the entries of the tree in dir.
+func readTree(dir string) (map[string]treeEntry, error) {
+	t := map[string]treeEntry{}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		r, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		e := treeEntry{mode: fi.Mode()}
+		switch {
+		case fi.Mode()&fs.ModeSymlink != 0:
+			if e.link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		case fi.Mode().IsRegular():
+			e.size = fi.Size()
+		}
+		t[r] = e
+		return nil
+	})
+	return t, err
+}
+
+// sameFile returns true if files a and b have the same contents.
+func sameFile(a, b string) (bool, error) {
+	ha, err := hashFile(a)
+	if err != nil {
+		return false, err
+	}
+	hb, err := hashFile(b)
+	return ha == hb, err
+}
+
+// diffTrees returns the differences between the trees in a and b.
+func diffTrees(a, b string) ([]string, error) {
+	ta, err := readTree(a)
+	if err != nil {
+		return nil, err
+	}
+	tb, err := readTree(b)
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for n := range ta {
+		names[n] = true
+	}
+	for n := range tb {
+		names[n] = true
+	}
+	var sorted []string
+	for n := range names {
+		sorted = append(sorted, n)
+	}
+	sort.Strings(sorted)
+	var diffs []string
+	for _, n := range sorted {
+		ea, inA := ta[n]
+		eb, inB := tb[n]
+		switch {
+		case !inA:
+			diffs = append(diffs, fmt.Sprintf("tree: %s: only in the second build", n))
+		case !inB:
+			diffs = append(diffs, fmt.Sprintf("tree: %s: only in the first build", n))
+		case ea.mode != eb.mode:
+			diffs = append(diffs, fmt.Sprintf("tree: %s: mode %v, then %v", n, ea.mode, eb.mode))
+		case ea.link != eb.link:
+			diffs = append(diffs, fmt.Sprintf("tree: %s: symlink to %q, then %q", n, ea.link, eb.link))
+		case ea.size != eb.size:
+			diffs = append(diffs, fmt.Sprintf("tree: %s: %d bytes, then %d", n, ea.size, eb.size))
+		case ea.mode.IsRegular():
+			same, err := sameFile(filepath.Join(a, n), filepath.Join(b, n))
+			if err != nil {
+				return nil, err
+			}
+			if !same {
+				diffs = append(diffs, fmt.Sprintf("tree: %s: contents differ", n))
+			}
+		}
+	}
+	return diffs, nil
+}
+
+// recordData returns the contents of r.
+func recordData(r cpio.Record) ([]byte, error) {
+	if r.ReaderAt == nil {
+		return nil, nil
+	}
+	return io.ReadAll(io.NewSectionReader(r, 0, int64(r.FileSize)))
+}
+
+// diffCPIO returns the differences between the records of the cpio
+// archives a and b.
+func diffCPIO(a, b string) ([]string, error) {
+	if same, err := sameFile(a, b); err != nil || same {
+		return nil, err
+	}
+	ra, err := readBase(a)
+	if err != nil {
+		return nil, err
+	}
+	rb, err := readBase(b)
+	if err != nil {
+		return nil, err
+	}
+	var diffs []string
+	for i := 0; i < len(ra) || i < len(rb); i++ {
+		switch {
+		case i >= len(ra):
+			diffs = append(diffs, fmt.Sprintf("cpio: record %d: %s: only in the second build", i, rb[i].Name))
+			continue
+		case i >= len(rb):
+			diffs = append(diffs, fmt.Sprintf("cpio: record %d: %s: only in the first build", i, ra[i].Name))
+			continue
+		}
+		if ra[i].Info != rb[i].Info {
+			diffs = append(diffs, fmt.Sprintf("cpio: record %d: %v, then %v", i, ra[i].Info, rb[i].Info))
+			continue
+		}
+		da, err := recordData(ra[i])
+		if err != nil {
+			return nil, err
+		}
+		db, err := recordData(rb[i])
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(da, db) {
+			diffs = append(diffs, fmt.Sprintf("cpio: record %d: %s: contents differ", i, ra[i].Name))
+		}
+	}
+	if len(diffs) == 0 {
+		diffs = append(diffs, fmt.Sprintf("cpio: %q and %q differ, but not in their records", a, b))
+	}
+	return diffs, nil
+}
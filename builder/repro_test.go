@@ -0,0 +1,49 @@
+// Copyright 2022 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package builder
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+func TestDiff(t *testing.T) {
+	d := t.TempDir()
+	fsys := func(motd string) fstest.MapFS {
+		return fstest.MapFS{
+			"etc/hosts": {Data: []byte("localhost\n"), Mode: 0644},
+			"etc/motd":  {Data: []byte(motd), Mode: 0644},
+		}
+	}
+	for n, f := range map[string]fstest.MapFS{"a": fsys("hi\n"), "b": fsys("ho\n"), "c": fsys("hi\n")} {
+		if err := writeTree(f, filepath.Join(d, n)); err != nil {
+			t.Fatal(err)
+		}
+		if err := (&Builder{}).ramfs(f, filepath.Join(d, n+".cpio")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tt := range []struct {
+		a, b string
+		want []string
+	}{
+		{"a", "c", nil},
+		{"a", "b", []string{"tree: etc/motd: contents differ", "cpio: record 3: etc/motd: contents differ"}},
+	} {
+		got, err := diffTrees(filepath.Join(d, tt.a), filepath.Join(d, tt.b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := diffCPIO(filepath.Join(d, tt.a+".cpio"), filepath.Join(d, tt.b+".cpio"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got = append(got, c...); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s and %s: got %q, want %q", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
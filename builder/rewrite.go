@@ -0,0 +1,42 @@
+// Copyright 2022 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package builder
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Rewrite rules, like git's url.<base>.insteadOf, fetch repos from
+// mirrors: a rule from=to fetches URLs starting with from from to and
+// the rest of the URL instead. The longest from that matches wins. Only
+// where repos are fetched from changes; they keep their names, and
+// their places in the workspace and the image.
+
+// checkRewrites returns an error for rules that are not from=to.
+func checkRewrites(rules []string) error {
+	for _, r := range rules {
+		if from, _, ok := strings.Cut(r, "="); !ok || from == "" {
+			return fmt.Errorf("rewrite %q: want from=to", r)
+		}
+	}
+	return nil
+}
+
+// rewrite returns where to fetch repo u from.
+func (b *Builder) rewrite(u string) string {
+	var from, to string
+	for _, r := range b.Rewrites {
+		f, t, _ := strings.Cut(r, "=")
+		if strings.HasPrefix(u, f) && len(f) > len(from) {
+			from, to = f, t
+		}
+	}
+	if from == "" {
+		return u
+	}
+	V("rewrite: fetch %q from %q", u, to+u[len(from):])
+	return to + u[len(from):]
+}
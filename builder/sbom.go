@@ -0,0 +1,293 @@
+// Copyright 2022 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package builder
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// The SBOM lists what went into the image: the Go toolchain, each repo
+// at its commit, and each module in the module cache with the hash of
+// its zip. It is an SPDX 2.3 JSON document, sbom.spdx.json, next to a
+// licenses directory with the license files of each of them. Both are
+// written to the SBOM directory and to /share/sbom in the image.
+//
+// Licenses are collected, not classified: the SPDX license fields say
+// NOASSERTION, and the texts are in licenses/.
+
+const sbomDir = "share/sbom"
+
+type spdxDoc struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+	Packages          []spdxPackage      `json:"packages"`
+	Relationships     []spdxRelationship `json:"relationships"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	Name             string         `json:"name"`
+	SPDXID           string         `json:"SPDXID"`
+	VersionInfo      string         `json:"versionInfo,omitempty"`
+	DownloadLocation string         `json:"downloadLocation"`
+	FilesAnalyzed    bool           `json:"filesAnalyzed"`
+	Checksums        []spdxChecksum `json:"checksums,omitempty"`
+	LicenseConcluded string         `json:"licenseConcluded"`
+	LicenseDeclared  string         `json:"licenseDeclared"`
+	CopyrightText    string         `json:"copyrightText"`
+	ExternalRefs     []spdxRef      `json:"externalRefs,omitempty"`
+	Comment          string         `json:"comment,omitempty"`
+
+	// dir is where the package is in the workspace, licenses the
+	// license files in it, and bundle where they go in licenses/.
+	dir      string
+	licenses []string
+	bundle   string
+}
+
+type spdxChecksum struct {
+	Algorithm     string `json:"algorithm"`
+	ChecksumValue string `json:"checksumValue"`
+}
+
+type spdxRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type spdxRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+// spdxID returns an SPDX identifier made from s.
+func spdxID(s string) string {
+	return "SPDXRef-" + strings.Map(func(r rune) rune {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' || r == '-') {
+			return r
+		}
+		return '-'
+	}, s)
+}
+
+// licenseFiles returns the license files at the top of dir.
+func licenseFiles(dir string) []string {
+	ents, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var files []string
+	for _, e := range ents {
+		n := strings.ToUpper(e.Name())
+		for _, p := range []string{"LICENSE", "LICENCE", "COPYING", "NOTICE", "PATENTS"} {
+			if e.Type().IsRegular() && strings.HasPrefix(n, p) {
+				files = append(files, e.Name())
+				break
+			}
+		}
+	}
+	return files
+}
+
+// unescapeModule undoes the module cache's escaping of upper case
+// letters as ! and the lower case letter.
+func unescapeModule(s string) string {
+	var b strings.Builder
+	bang := false
+	for _, r := range s {
+		switch {
+		case r == '!':
+			bang = true
+			continue
+		case bang:
+			r = unicode.ToUpper(r)
+		}
+		bang = false
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// hashFile returns the hex SHA-256 of file.
+func hashFile(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// modules returns a package for each module zip in the module cache
+// of GOPATH d, sorted by path and version.
+func modules(d string) ([]spdxPackage, error) {
+	cache := filepath.Join(d, "pkg/mod/cache/download")
+	var pkgs []spdxPackage
+	err := filepath.WalkDir(cache, func(p string, e os.DirEntry, err error) error {
+		if os.IsNotExist(err) && p == cache {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if e.IsDir() || filepath.Base(filepath.Dir(p)) != "@v" || filepath.Ext(p) != ".zip" {
+			return nil
+		}
+		esc, err := filepath.Rel(cache, filepath.Dir(filepath.Dir(p)))
+		if err != nil {
+			return err
+		}
+		escVersion := strings.TrimSuffix(filepath.Base(p), ".zip")
+		mod, version := unescapeModule(filepath.ToSlash(esc)), unescapeModule(escVersion)
+		sum, err := hashFile(p)
+		if err != nil {
+			return err
+		}
+		pkg := spdxPackage{
+			Name:             mod,
+			SPDXID:           spdxID(mod + "@" + version),
+			VersionInfo:      version,
+			DownloadLocation: "https://proxy.golang.org/" + filepath.ToSlash(esc) + "/@v/" + escVersion + ".zip",
+			Checksums:        []spdxChecksum{{"SHA256", sum}},
+			ExternalRefs:     []spdxRef{{"PACKAGE-MANAGER", "purl", "pkg:golang/" + mod + "@" + version}},
+			dir:              filepath.Join(d, "pkg/mod", esc+"@"+escVersion),
+			bundle:           mod + "@" + version,
+		}
+		if h, err := os.ReadFile(strings.TrimSuffix(p, ".zip") + ".ziphash"); err == nil {
+			pkg.Comment = "go.sum " + strings.TrimSpace(string(h))
+		}
+		pkgs = append(pkgs, pkg)
+		return nil
+	})
+	sort.Slice(pkgs, func(i, j int) bool { return pkgs[i].SPDXID < pkgs[j].SPDXID })
+	return pkgs, err
+}
+
+// sbom writes the SBOM and licenses to the SBOM directory and the image.
+func (b *Builder) sbom(ctx context.Context) error {
+	d := b.Workspace
+	var pkgs []spdxPackage
+	repo := func(name, u, dir string) {
+		c, err := git(ctx, dir, "rev-parse", "HEAD")
+		if err != nil {
+			V("sbom: %q: %v", name, err)
+			return
+		}
+		pkgs = append(pkgs, spdxPackage{
+			Name:             name,
+			SPDXID:           spdxID(name),
+			VersionInfo:      c,
+			DownloadLocation: "git+" + u + "@" + c,
+			dir:              dir,
+			bundle:           name,
+		})
+	}
+	repo("go", goRepo, filepath.Join(d, "go"))
+	for _, u := range b.repos() {
+		host, dir, base, err := goName(u)
+		if err != nil {
+			return err
+		}
+		repo(path.Join(host, dir, base), u, filepath.Join(d, "src", host, dir, base))
+	}
+	mods, err := modules(b.goPath())
+	if err != nil {
+		return fmt.Errorf("module cache: %v", err)
+	}
+	pkgs = append(pkgs, mods...)
+
+	img := spdxID("image-" + b.OS + "-" + b.Arch)
+	doc := spdxDoc{
+		SPDXVersion: "SPDX-2.3",
+		DataLicense: "CC0-1.0",
+		SPDXID:      "SPDXRef-DOCUMENT",
+		Name:        "sourcery " + b.Version + " " + b.OS + "_" + b.Arch,
+		CreationInfo: spdxCreationInfo{
+			Created:  b.img.mtime.UTC().Format("2006-01-02T15:04:05Z"),
+			Creators: []string{"Tool: sourcery"},
+		},
+		Packages: []spdxPackage{{
+			Name:             "sourcery image " + b.OS + "_" + b.Arch,
+			SPDXID:           img,
+			DownloadLocation: "NOASSERTION",
+			LicenseConcluded: "NOASSERTION",
+			LicenseDeclared:  "NOASSERTION",
+			CopyrightText:    "NOASSERTION",
+		}},
+		Relationships: []spdxRelationship{{"SPDXRef-DOCUMENT", "DESCRIBES", img}},
+	}
+	// The namespace must be unique to this document, so it is a hash
+	// of what is in it.
+	h := sha256.New()
+	for i := range pkgs {
+		p := &pkgs[i]
+		p.LicenseConcluded, p.LicenseDeclared, p.CopyrightText = "NOASSERTION", "NOASSERTION", "NOASSERTION"
+		p.licenses = licenseFiles(p.dir)
+		if len(p.licenses) > 0 {
+			p.Comment = strings.TrimSpace(p.Comment + " licenses in " + path.Join("licenses", p.bundle))
+		}
+		fmt.Fprintf(h, "%s %s %v\n", p.SPDXID, p.VersionInfo, p.Checksums)
+		doc.Packages = append(doc.Packages, *p)
+		doc.Relationships = append(doc.Relationships, spdxRelationship{img, "CONTAINS", p.SPDXID})
+	}
+	doc.DocumentNamespace = fmt.Sprintf("https://github.com/u-root/sourcery/spdx/%08x-%x", b.id, h.Sum(nil)[:8])
+	dat, err := json.MarshalIndent(doc, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(b.SBOM, 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(b.SBOM, "sbom.spdx.json"), dat, 0644); err != nil {
+		return err
+	}
+	b.img.WriteFile(path.Join(sbomDir, "sbom.spdx.json"), dat, 0644)
+	for _, p := range pkgs {
+		for _, l := range p.licenses {
+			from, to := filepath.Join(p.dir, l), path.Join("licenses", p.bundle, l)
+			f, err := os.Open(from)
+			if err != nil {
+				return err
+			}
+			err = os.MkdirAll(filepath.Join(b.SBOM, filepath.Dir(to)), 0755)
+			if err == nil {
+				err = copyFile(filepath.Join(b.SBOM, to), f, 0644)
+			}
+			f.Close()
+			if err != nil {
+				return err
+			}
+			b.img.CopyFile(path.Join(sbomDir, to), from, 0644)
+		}
+	}
+	V("sbom: %d packages in %q", len(pkgs), b.SBOM)
+	return nil
+}
@@ -0,0 +1,113 @@
+// Copyright 2022 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package builder
+
+import (
+	"context"
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSBOM(t *testing.T) {
+	d := t.TempDir()
+	for n, dat := range map[string]string{
+		"src/pkg/mod/cache/download/github.com/!foo/bar/@v/v1.0.0.zip":     "zip",
+		"src/pkg/mod/cache/download/github.com/!foo/bar/@v/v1.0.0.ziphash": "h1:x=",
+		"src/pkg/mod/github.com/!foo/bar@v1.0.0/LICENSE":                   "BSD",
+	} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(d, n)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(d, n), []byte(dat), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out := t.TempDir()
+	b, err := New(Options{OS: "linux", Arch: "amd64", Workspace: d, SBOM: out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := b.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.sbom(ctx); err != nil {
+		t.Fatal(err)
+	}
+	dat, err := os.ReadFile(filepath.Join(out, "sbom.spdx.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc spdxDoc
+	if err := json.Unmarshal(dat, &doc); err != nil {
+		t.Fatal(err)
+	}
+	// The image, and the module; there are no repos.
+	if len(doc.Packages) != 2 {
+		t.Fatalf("packages: got %+v, want the image and github.com/Foo/bar", doc.Packages)
+	}
+	p := doc.Packages[1]
+	const sum = "4a70fe9aa6436e02c2dea340fbd1e352e4ef2d8ce6ca52ad25d4b95471fc8bf2" // of "zip"
+	if p.Name != "github.com/Foo/bar" || p.VersionInfo != "v1.0.0" || len(p.Checksums) != 1 || p.Checksums[0].ChecksumValue != sum {
+		t.Errorf("module: got %+v, want github.com/Foo/bar v1.0.0 with SHA256 %s", p, sum)
+	}
+	const l = "licenses/github.com/Foo/bar@v1.0.0/LICENSE"
+	if _, err := os.Stat(filepath.Join(out, l)); err != nil {
+		t.Errorf("license beside the output: %v", err)
+	}
+	if _, err := fs.Stat(b.img, sbomDir+"/"+l); err != nil {
+		t.Errorf("license in the image: %v", err)
+	}
+}
+
+func TestSBOMDeps(t *testing.T) {
+	// The proxy has no checksum database.
+	t.Setenv("GOSUMDB", "off")
+	d := testWorkspace(t)
+	out := t.TempDir()
+	b, err := New(Options{OS: "linux", Arch: "amd64", Workspace: d, SBOM: out, GOPROXY: "file://" + testProxy(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := b.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	repo := filepath.Join(d, "src", "example.com", "repo")
+	for n, s := range map[string]string{
+		"go.mod":  "module example.com/repo\n\ngo 1.17\n",
+		"main.go": "package main\n\nimport \"example.com/dep\"\n\nfunc main() { println(dep.S) }\n",
+	} {
+		if err := os.MkdirAll(repo, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(repo, n), []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.tidy(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.sbom(ctx); err != nil {
+		t.Fatal(err)
+	}
+	dat, err := os.ReadFile(filepath.Join(out, "sbom.spdx.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc spdxDoc
+	if err := json.Unmarshal(dat, &doc); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range doc.Packages {
+		if p.Name == "example.com/dep" && p.VersionInfo == "v1.0.0" {
+			return
+		}
+	}
+	t.Errorf("packages: got %+v, want example.com/dep v1.0.0", doc.Packages)
+}
@@ -0,0 +1,71 @@
+// Copyright 2022 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package builder
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+
+	"github.com/u-root/sourcery/manifest"
+)
+
+// An image may carry a manifest of the hashes of its files, signed
+// with an ed25519 key. The public key is built into init, which checks
+// the manifest at boot and, by policy, refuses to go on or warns if
+// files do not match; and into installcommand, which checks the
+// sources of each command before compiling it.
+
+// loadSignKey reads the PEM PKCS #8 ed25519 private key in file, as
+// made by openssl genpkey -algorithm ed25519.
+func loadSignKey(file string) (ed25519.PrivateKey, error) {
+	dat, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	p, _ := pem.Decode(dat)
+	if p == nil {
+		return nil, fmt.Errorf("%q: no PEM key", file)
+	}
+	k, err := x509.ParsePKCS8PrivateKey(p.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%q: %v", file, err)
+	}
+	key, ok := k.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%q: got a %T, want an ed25519 key", file, k)
+	}
+	return key, nil
+}
+
+// toolFlags returns the go build flags for the tools: -trimpath, so
+// they do not depend on where the workspace is, and, if signing, the
+// public key and policy.
+func (b *Builder) toolFlags() []string {
+	flags := []string{"-trimpath"}
+	if b.signKey == nil {
+		return flags
+	}
+	pub := base64.StdEncoding.EncodeToString(b.signKey.Public().(ed25519.PublicKey))
+	return append(flags, "-ldflags", fmt.Sprintf("-X main.manifestKey=%s -X main.manifestPolicy=%s", pub, b.VerifyPolicy))
+}
+
+// sign adds the manifest of the image, and its signature, to it. The
+// kernels and EFI binaries are left out: they are not in the cpio, so
+// init cannot check them.
+func (b *Builder) sign() error {
+	b.img.WriteFile(manifest.SourcePolicyFile, []byte(b.SourcePolicy+"\n"), 0644)
+	m, err := manifest.Make(b.img, func(n string) bool { return b.bootOnly[n] })
+	if err != nil {
+		return err
+	}
+	b.img.WriteFile(manifest.File, m, 0644)
+	b.img.WriteFile(manifest.Sig, manifest.Sign(m, b.signKey), 0644)
+	V("sign: %d bytes of manifest", len(m))
+	return nil
+}
@@ -0,0 +1,275 @@
+// Copyright 2022 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package builder
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+
+	"github.com/hashicorp/go-multierror"
+	url "github.com/whilp/git-urls"
+)
+
+// Little note here: you'll see we use go/bin/go a lot, instead of kern_arch/bin/go.
+// Lessons learned the hard way: go/bin/go seems to do a better job of finding
+// GOROOT and other things when run from go/bin. We have not confirmed this from code,
+// but from running it: best to run go/bin/go when doing this build.
+// Will it work for replication? Remains to be seen.
+
+func clone(ctx context.Context, tmp, version, repo, dir, base string) error {
+	V("clone: %q, %q, %q, %q", tmp, version, dir, base)
+	dest := filepath.Join(tmp, dir)
+	if _, err := os.Stat(filepath.Join(dest, base, ".git")); err == nil {
+		V("clone: %q is already there, fetch", filepath.Join(dest, base))
+		// Fetch from repo, even if it was cloned from elsewhere.
+		if o, err := git(ctx, filepath.Join(dest, base), "remote", "get-url", "origin"); err == nil && o != repo {
+			V("clone: origin of %q moves from %q to %q", filepath.Join(dest, base), o, repo)
+			if _, err := git(ctx, filepath.Join(dest, base), "remote", "set-url", "origin", repo); err != nil {
+				return err
+			}
+		}
+		return fetch(ctx, filepath.Join(dest, base), version)
+	}
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+	cmd := []string{"clone", "--depth", "1"}
+	if len(version) > 0 {
+		cmd = append(cmd, "-b", version)
+	}
+	cmd = append(cmd, repo, base)
+	c := exec.CommandContext(ctx, "git", cmd...)
+	c.Dir = dest
+	c.Stdout, c.Stderr = os.Stdout, os.Stderr
+	if err := c.Run(); err != nil {
+		return err
+	}
+	_, err := git(ctx, filepath.Join(dest, base), "update-ref", upstreamRef, "HEAD")
+	return err
+}
+
+// goEnv returns the environment for building for the target.
+func (b *Builder) goEnv() []string {
+	env := []string{"GOARCH=" + b.Arch, "GOOS=" + b.OS, "GOROOT_FINAL=/go", "CGO_ENABLED=0"}
+	if a, ok := os.LookupEnv("GOARM"); ok {
+		env = append(env, "GOARM="+a)
+	}
+	return env
+}
+
+// tidy runs go mod tidy in dir, which fills the module cache.
+func (b *Builder) tidy(ctx context.Context, dir string) error {
+	c := b.goCmd(ctx, dir, "mod", "tidy")
+	c.Stdout = os.Stdout
+	V("Run %q in %q", c.Args, c.Dir)
+	return c.Run()
+}
+
+// modinit creates a go.mod for module m in dir, if it has none.
+func (b *Builder) modinit(ctx context.Context, dir, m string) error {
+	V("modinit: check %q for go.mod", dir)
+	if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+		V("modinit: it has go.mod")
+		return nil
+	}
+	c := b.goCmd(ctx, dir, "mod", "init", m)
+	c.Stdout = os.Stdout
+	V("Run %q in %q", c.Args, c.Dir)
+	return c.Run()
+}
+
+// goRepo is where the Go toolchain comes from.
+const goRepo = "git@github.com:golang/go"
+
+// getgo clones or updates the Go toolchain at version from repo.
+func getgo(ctx context.Context, d, version, repo string) error {
+	if err := clone(ctx, d, version, repo, "", "go"); err != nil {
+		return err
+	}
+	// simply sanity check
+	gover := filepath.Join(d, "go", "VERSION")
+	dat, err := ioutil.ReadFile(gover)
+	if err != nil {
+		return fmt.Errorf("Reading %q: %v", gover, err)
+	}
+	if string(dat) != version {
+		return fmt.Errorf("Version file has %q, but want version %q", string(dat), version)
+	}
+	return nil
+}
+
+// build builds the code found in filepath.Join(sourcePath, dir), for
+// the target, into bin, with the workspace's toolchain.
+func (b *Builder) build(ctx context.Context, sourcePath, dir, bin string, extra ...string) error {
+	c := exec.CommandContext(ctx, filepath.Join(b.Workspace, "go/bin/go"), "build", "-o", bin)
+	c.Args = append(c.Args, extra...)
+	c.Dir = filepath.Join(sourcePath, dir)
+	c.Stdout, c.Stderr = os.Stdout, os.Stderr
+	c.Env = append(os.Environ(), b.goPathEnv()...)
+	c.Env = append(c.Env, b.goEnv()...)
+	if err := c.Run(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// buildToolchain builds the needed Go toolchain binaries: go, compile, link,
+// asm. We can no longer do this without the script. Damn.
+// TODO: figure out what files we can remove.
+func (b *Builder) buildToolchain(ctx context.Context) error {
+	tmp := b.Workspace
+	c := exec.CommandContext(ctx, "bash", "make.bash")
+	c.Dir = filepath.Join(tmp, "go/src")
+	c.Stdout, c.Stderr = os.Stdout, os.Stderr
+	c.Env = os.Environ()
+	c.Env = append(c.Env, "GOROOT_FINAL=/go", "CGO_ENABLED=0")
+	if err := c.Run(); err != nil {
+		return err
+	}
+	// Need to also build the go command itself.
+	c = exec.CommandContext(ctx, filepath.Join(tmp, "go/bin/go"), "build", "-o", filepath.Join(tmp, b.bin, "go"))
+	c.Dir = filepath.Join(tmp, "go/src/cmd/go")
+	c.Stdout, c.Stderr = os.Stdout, os.Stderr
+	c.Env = os.Environ()
+	c.Env = append(c.Env, b.goEnv()...)
+	V("Build go toolchain, Args %v, Env %v", c.Args, c.Env)
+	if err := c.Run(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func goName(p string) (string, string, string, error) {
+	u, err := url.ParseScp(p)
+	if err != nil {
+		return "", "", "", err
+	}
+	// The `Host` contains both the hostname and the port,
+	// if present. Use `SplitHostPort` to extract them.
+	V("goName: host %q", u.Host)
+	host, _, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		host = u.Host
+	}
+	return host, filepath.Dir(u.Path), filepath.Base(u.Path), nil
+}
+
+// get clones or updates each repo in args into target, each in a fetch
+// and a tidy phase. Repos that have not changed since they were last
+// tidied are left alone.
+func (b *Builder) get(ctx context.Context, target string, args ...string) error {
+	st := b.st
+	var err error
+	for _, d := range args {
+		V("Get %q", d)
+		host, dir, base, e := goName(d)
+		if e != nil {
+			V("URL %q: %v", d, e)
+			err = multierror.Append(err, fmt.Errorf("%q: %v", d, e))
+			continue
+		}
+		dir = filepath.Join(host, dir)
+		V("goName for %q: %q, %q, %q", d, host, dir, base)
+		if e := b.phase(ctx, "fetch "+d, filepath.Join(target, dir, base), func() error {
+			if err := clone(ctx, target, "", b.rewrite(d), dir, base); err != nil {
+				return err
+			}
+			if c, ok := b.Pins[d]; ok {
+				if err := pin(ctx, filepath.Join(target, dir, base), c); err != nil {
+					return fmt.Errorf("pin %q at %s: %v", d, c, err)
+				}
+			}
+			return b.patch(ctx, d, filepath.Join(target, dir, base))
+		}); e != nil {
+			st.rep.repo(ctx, d, filepath.Join(target, dir, base), e)
+			err = multierror.Append(err, e)
+			continue
+		}
+		st.rep.measure("fetch "+d, filepath.Join(target, dir, base))
+		e = b.phase(ctx, "tidy "+d, filepath.Join(target, dir, base), func() error {
+			head, err := git(ctx, filepath.Join(target, dir, base), "rev-parse", "HEAD")
+			if err != nil {
+				return err
+			}
+			if st.fresh("get "+d, head) {
+				return nil
+			}
+			if err := b.modinit(ctx, filepath.Join(target, dir, base), filepath.Join(dir, base)); err != nil {
+				return err
+			}
+			if err := b.tidy(ctx, filepath.Join(target, dir, base)); err != nil {
+				return err
+			}
+			return st.stamp("get "+d, head)
+		})
+		st.rep.repo(ctx, d, filepath.Join(target, dir, base), e)
+		if e != nil {
+			err = multierror.Append(err, e)
+		}
+	}
+	return err
+}
+
+func tree(img *overlay) {
+	for _, n := range []string{"tmp", "dev", "etc"} {
+		img.Mkdir(n, 0755)
+	}
+}
+
+// There are certain common patterns we know are commands.
+// Just Do It.
+var commandPatterns = []string{
+	"/src/github.com/u-root/u-root/cmds/*/*",
+	"/src/github.com/u-root/NiChrome/cmds/*",
+	"/src/github.com/u-root/cpu/cmds/*",
+	"/src/github.com/nsf/godit",
+}
+
+// commands returns the command directories in the workspace tmp.
+func commands(tmp string) []string {
+	var dirs []string
+	for _, g := range commandPatterns {
+		m, err := filepath.Glob(filepath.Join(tmp, g))
+		if err != nil {
+			V("%q: %v", g, err)
+			continue
+		}
+		dirs = append(dirs, m...)
+	}
+	return dirs
+}
+
+// files writes stubs for the commands found in the workspace tmp
+// into the image directory binpath, but for those in skip.
+func files(tmp, binpath string, img *overlay, skip map[string]bool) error {
+	var err error
+	include := filepath.Join(tmp, "go/pkg/include")
+	if err = os.MkdirAll(include, 0755); err != nil {
+		return err
+	}
+
+	for _, n := range commands(tmp) {
+		r, e := filepath.Rel(tmp, n)
+		if e != nil {
+			err = multierror.Append(err, e)
+		}
+		if skip[filepath.Base(n)] {
+			V("Skip the stub for %q", n)
+			continue
+		}
+		f := path.Join(binpath, filepath.Base(n))
+		dat := []byte("#!/" + binpath + "/installcommand #!/" + r + "\n")
+		V("Write %q with %q", f, dat)
+		img.WriteFile(f, dat, 0755)
+	}
+
+	return err
+}
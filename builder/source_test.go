@@ -0,0 +1,97 @@
+// Copyright 2022 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package builder
+
+import (
+	"context"
+	"debug/elf"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// crossArch returns an architecture that is not the host's.
+func crossArch() string {
+	if runtime.GOARCH == "arm64" {
+		return "amd64"
+	}
+	return "arm64"
+}
+
+// testWorkspace returns a workspace whose toolchain is the host's Go,
+// skipping the test if there is none.
+func testWorkspace(t *testing.T) string {
+	t.Helper()
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skipf("no go: %v", err)
+	}
+	if goBin, err = filepath.EvalSymlinks(goBin); err != nil {
+		t.Fatal(err)
+	}
+	d := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(d, "go", "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(goBin, filepath.Join(d, "go", "bin", "go")); err != nil {
+		t.Fatal(err)
+	}
+	// The module cache is read-only.
+	t.Cleanup(func() {
+		filepath.WalkDir(d, func(p string, e fs.DirEntry, err error) error {
+			if err == nil && e.IsDir() {
+				os.Chmod(p, 0755)
+			}
+			return nil
+		})
+	})
+	return d
+}
+
+// writeCommand writes a module with a main package, cmd, in dir.
+func writeCommand(t *testing.T, dir string) {
+	t.Helper()
+	for n, s := range map[string]string{
+		"go.mod":      "module example.com/cmd\n\ngo 1.17\n",
+		"cmd/main.go": "package main\n\nfunc main() {}\n",
+	} {
+		p := filepath.Join(dir, n)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// checkMachine checks that the ELF file p is for arch.
+func checkMachine(t *testing.T, p, arch string) {
+	t.Helper()
+	f, err := elf.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if f.Machine != elfMachines[arch] {
+		t.Errorf("%q: got %v, want %v", p, f.Machine, elfMachines[arch])
+	}
+}
+
+func TestBuild(t *testing.T) {
+	d := testWorkspace(t)
+	src := t.TempDir()
+	writeCommand(t, src)
+	arch := crossArch()
+	b := &Builder{Options: Options{Workspace: d, OS: "linux", Arch: arch}}
+	bin := filepath.Join(d, "cmd")
+	if err := b.build(context.Background(), src, "cmd", bin); err != nil {
+		t.Fatal(err)
+	}
+	checkMachine(t, bin, arch)
+}
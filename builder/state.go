@@ -0,0 +1,310 @@
+// Copyright 2022 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package builder
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Building into an existing workspace only redoes what changed. Each
+// expensive step records a key describing its inputs -- a commit, a
+// hash of the sources -- in a state file in the workspace, and is
+// skipped when the key has not changed. The state directory is hidden
+// from the image.
+//
+// The state also records the phases of the current build as they
+// finish, so that a build that failed part way, say on a network
+// hiccup, can be continued with -resume from the first phase that did
+// not finish, without even checking whether the others are up to date.
+
+const stateDir = ".sourcery"
+
+type state struct {
+	file   string
+	Stamps map[string]string `json:"stamps"`
+	Args   []string          `json:"args"`
+	Done   []string          `json:"done"`
+	resume bool
+	rep    *buildReport
+}
+
+// volatile phases build only in memory, or write the outputs from
+// what was built in memory, so they are redone even when resuming: the
+// outputs asked for may not be the last build's.
+var volatile = map[string]bool{
+	"stubs":   true,
+	"boot":    true,
+	"archive": true,
+}
+
+// loadState reads the state of workspace d. A workspace with no state
+// has nothing done.
+func loadState(d string) (*state, error) {
+	s := &state{file: filepath.Join(d, stateDir, "state.json"), Stamps: map[string]string{}}
+	dat, err := os.ReadFile(s.file)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(dat, s); err != nil {
+		return nil, fmt.Errorf("%q: %v", s.file, err)
+	}
+	if s.Stamps == nil {
+		s.Stamps = map[string]string{}
+	}
+	return s, nil
+}
+
+func (s *state) save() error {
+	dat, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.file), 0755); err != nil {
+		return err
+	}
+	tmp := s.file + ".tmp"
+	if err := os.WriteFile(tmp, dat, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.file)
+}
+
+// fresh returns true if step was last done with inputs key.
+func (s *state) fresh(step, key string) bool {
+	if key == "" {
+		return false
+	}
+	ok := s.Stamps[step] == key
+	if ok {
+		V("%s: up to date", step)
+	}
+	return ok
+}
+
+// stamp records that step was done with inputs key.
+func (s *state) stamp(step, key string) error {
+	s.Stamps[step] = key
+	return s.save()
+}
+
+// start begins a build of args. If resume, it continues the last build,
+// which must have been of the same args.
+func (s *state) start(args []string, resume bool) error {
+	if resume {
+		if strings.Join(s.Args, " ") != strings.Join(args, " ") {
+			return fmt.Errorf("-resume: the last build was of %q, not %q", s.Args, args)
+		}
+		V("resume: done %q", s.Done)
+		s.resume = true
+		return nil
+	}
+	s.Args, s.Done = args, nil
+	return s.save()
+}
+
+// skip returns true if phase name is done and the build is resuming.
+func (s *state) skip(name string) bool {
+	if !s.resume || volatile[name] {
+		return false
+	}
+	for _, n := range s.Done {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// phase runs f as the named phase of the build, and records that it is
+// done if it succeeds. When resuming, phases that are done are skipped.
+func (s *state) phase(name string, f func() error) error {
+	start := time.Now()
+	if s.skip(name) {
+		V("resume: skip %q", name)
+		if err := s.rep.phase(name, start, true, nil); err != nil {
+			V("report: %v", err)
+		}
+		return nil
+	}
+	V("phase %q", name)
+	err := f()
+	if e := s.rep.phase(name, start, false, err); e != nil {
+		V("report: %v", e)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	for _, n := range s.Done {
+		if n == name {
+			return nil
+		}
+	}
+	s.Done = append(s.Done, name)
+	return s.save()
+}
+
+// git runs git in dir and returns its trimmed output.
+func git(ctx context.Context, dir string, args ...string) (string, error) {
+	return gitEnv(ctx, dir, nil, args...)
+}
+
+// gitEnv runs git in dir, with env added to its environment, and
+// returns its trimmed output.
+func gitEnv(ctx context.Context, dir string, env []string, args ...string) (string, error) {
+	c := exec.CommandContext(ctx, "git", args...)
+	c.Dir = dir
+	if env != nil {
+		c.Env = append(os.Environ(), env...)
+	}
+	c.Stderr = os.Stderr
+	out, err := c.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %v in %q: %v", args, dir, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// remoteRev returns the commit that ref names on the origin of the repo
+// in dir. An empty ref means the remote's HEAD.
+func remoteRev(ctx context.Context, dir, ref string) (string, error) {
+	if ref == "" {
+		ref = "HEAD"
+	}
+	out, err := git(ctx, dir, "ls-remote", "origin", ref, ref+"^{}")
+	if err != nil {
+		return "", err
+	}
+	var rev string
+	for _, l := range strings.Split(out, "\n") {
+		f := strings.Fields(l)
+		if len(f) != 2 {
+			continue
+		}
+		// An annotated tag's commit is the peeled ^{} line.
+		if rev == "" || strings.HasSuffix(f[1], "^{}") {
+			rev = f[0]
+		}
+	}
+	if rev == "" {
+		return "", fmt.Errorf("%q: no ref %q on origin", dir, ref)
+	}
+	return rev, nil
+}
+
+// upstreamRef names the commit last fetched, which HEAD may be ahead
+// of if patches were applied.
+const upstreamRef = "refs/sourcery/upstream"
+
+// fetch brings the shallow clone in dir up to date with ref, or the
+// remote's HEAD, fetching only if it has moved.
+func fetch(ctx context.Context, dir, ref string) error {
+	if ref == "" {
+		ref = "HEAD"
+	}
+	head, err := git(ctx, dir, "rev-parse", "--verify", "-q", upstreamRef)
+	if err != nil {
+		// Cloned before there were patches.
+		if head, err = git(ctx, dir, "rev-parse", "HEAD"); err != nil {
+			return err
+		}
+	}
+	rev, err := remoteRev(ctx, dir, ref)
+	if err != nil {
+		return err
+	}
+	if rev == head {
+		V("fetch %q: %q is still %s", dir, ref, head)
+		return nil
+	}
+	V("fetch %q: %q moved from %s to %s", dir, ref, head, rev)
+	if _, err := git(ctx, dir, "fetch", "--depth", "1", "origin", ref); err != nil {
+		return err
+	}
+	if _, err := git(ctx, dir, "reset", "--hard", "FETCH_HEAD"); err != nil {
+		return err
+	}
+	_, err = git(ctx, dir, "update-ref", upstreamRef, "HEAD")
+	return err
+}
+
+// pin moves the clone in dir to commit, fetching it if need be.
+func pin(ctx context.Context, dir, commit string) error {
+	if up, err := git(ctx, dir, "rev-parse", "--verify", "-q", upstreamRef); err == nil && up == commit {
+		return nil
+	}
+	V("pin %q: at %s", dir, commit)
+	if _, err := git(ctx, dir, "cat-file", "-e", commit+"^{commit}"); err != nil {
+		if _, err := git(ctx, dir, "fetch", "--depth", "1", "origin", commit); err != nil {
+			return err
+		}
+	}
+	if _, err := git(ctx, dir, "reset", "--hard", "-q", commit); err != nil {
+		return err
+	}
+	_, err := git(ctx, dir, "update-ref", upstreamRef, commit)
+	return err
+}
+
+// srcKey returns a hash of the names and contents of the regular files
+// in paths, which may be files or directories. Paths that do not exist
+// hash as empty.
+func srcKey(paths ...string) (string, error) {
+	h := sha256.New()
+	for _, p := range paths {
+		if err := filepath.WalkDir(p, func(n string, d fs.DirEntry, err error) error {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if d.IsDir() && d.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			f, err := os.Open(n)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			fmt.Fprintf(h, "%s\x00", n)
+			_, err = io.Copy(h, f)
+			return err
+		}); err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// toolchainKey returns the key for the toolchain in the workspace: its
+// commit and the target.
+func (b *Builder) toolchainKey(ctx context.Context) string {
+	d := b.Workspace
+	head, err := git(ctx, filepath.Join(d, "go"), "rev-parse", "HEAD")
+	if err != nil {
+		V("toolchain: %v", err)
+		return ""
+	}
+	if _, err := os.Stat(filepath.Join(d, b.bin, "go")); err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%s %s_%s", head, b.OS, b.Arch)
+}
@@ -0,0 +1,48 @@
+// Copyright 2022 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package builder
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestResume(t *testing.T) {
+	d := t.TempDir()
+	args := []string{"go1.17.7", "linux", "amd64"}
+	s, err := loadState(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.start(args, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []string{"toolchain", "stubs", "archive"} {
+		if err := s.phase(n, func() error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s, err = loadState(d); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.start(args, true); err != nil {
+		t.Fatal(err)
+	}
+	for n, want := range map[string]bool{"toolchain": true, "get": false, "stubs": false, "archive": false} {
+		if got := s.skip(n); got != want {
+			t.Errorf("skip(%q): got %v, want %v", n, got, want)
+		}
+	}
+	// A report that cannot be written does not fail the build.
+	s.rep = newReport(filepath.Join(d, "no", "report.json"), d, args[0], args[1], args[2], nil)
+	for _, n := range []string{"toolchain", "get"} {
+		if err := s.phase(n, func() error { return nil }); err != nil {
+			t.Errorf("phase %q: got %v, want nil", n, err)
+		}
+	}
+	if err := s.start(append(args, "github.com/u-root/u-root"), true); err == nil {
+		t.Errorf("resuming with other args: got nil, want error")
+	}
+}
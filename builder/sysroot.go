@@ -0,0 +1,220 @@
+// Copyright 2022 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package builder
+
+import (
+	"debug/elf"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// For targets other than the host, the shared libraries of dynamically
+// linked files are found in a sysroot, a root filesystem for the
+// target, as the dynamic loader would find them there: by the
+// binaries' DT_NEEDED entries, in their DT_RPATH or DT_RUNPATH, the
+// directories in /etc/ld.so.conf, and the default ones. Nothing is run.
+// The libraries go in the image where the loader looks for them, and
+// the interpreter at its PT_INTERP path.
+
+// maxLinks is how many symlinks resolveIn follows.
+const maxLinks = 40
+
+// resolveIn returns the file on the host for p, a path in root,
+// following symlinks as if root were /.
+func resolveIn(root, p string) (string, error) {
+	p = path.Clean("/" + p)
+	for n := 0; n < maxLinks; n++ {
+		parts := strings.Split(strings.TrimPrefix(p, "/"), "/")
+		link := false
+		for i := range parts {
+			cur := "/" + path.Join(parts[:i+1]...)
+			host := filepath.Join(root, filepath.FromSlash(cur))
+			fi, err := os.Lstat(host)
+			if err != nil {
+				return "", err
+			}
+			if fi.Mode()&fs.ModeSymlink == 0 {
+				continue
+			}
+			t, err := os.Readlink(host)
+			if err != nil {
+				return "", err
+			}
+			if !path.IsAbs(t) {
+				t = path.Join(path.Dir(cur), t)
+			}
+			p, link = path.Clean("/"+path.Join(append([]string{t}, parts[i+1:]...)...)), true
+			break
+		}
+		if !link {
+			return filepath.Join(root, filepath.FromSlash(p)), nil
+		}
+	}
+	return "", fmt.Errorf("%q in %q: too many symlinks", p, root)
+}
+
+// ldConf returns the directories in ld.so.conf file p, in root, and
+// the files it includes.
+func ldConf(root, p string, depth int) []string {
+	var dirs []string
+	if depth > maxLinks {
+		return nil
+	}
+	host, err := resolveIn(root, p)
+	if err != nil {
+		return nil
+	}
+	eachLine(host, func(l string) error {
+		l, _, _ = strings.Cut(l, "#")
+		f := strings.Fields(l)
+		switch {
+		case len(f) == 0:
+		case f[0] == "include" && len(f) == 2:
+			pat := f[1]
+			if !path.IsAbs(pat) {
+				pat = path.Join(path.Dir(p), pat)
+			}
+			m, _ := filepath.Glob(filepath.Join(root, filepath.FromSlash(pat)))
+			for _, inc := range m {
+				r, err := filepath.Rel(root, inc)
+				if err == nil {
+					dirs = append(dirs, ldConf(root, filepath.ToSlash(r), depth+1)...)
+				}
+			}
+		default:
+			dirs = append(dirs, f[0])
+		}
+		return nil
+	})
+	return dirs
+}
+
+// ldDirs are the directories the loader searches after those in
+// ld.so.conf.
+var ldDirs = []string{"/lib", "/usr/lib", "/lib64", "/usr/lib64"}
+
+// elfDeps returns the interpreter, the DT_NEEDED libraries and the
+// directories to look for them in, $ORIGIN expanded to origin, of the
+// ELF file p.
+func elfDeps(p, origin string) (*elf.File, string, []string, []string, error) {
+	f, err := elf.Open(p)
+	if err != nil {
+		return nil, "", nil, nil, err
+	}
+	var interp string
+	for _, prog := range f.Progs {
+		if prog.Type != elf.PT_INTERP {
+			continue
+		}
+		dat, err := io.ReadAll(prog.Open())
+		if err != nil {
+			f.Close()
+			return nil, "", nil, nil, err
+		}
+		interp = strings.TrimRight(string(dat), "\x00")
+	}
+	needed, err := f.ImportedLibraries()
+	if err != nil {
+		f.Close()
+		return nil, "", nil, nil, err
+	}
+	// DT_RPATH is ignored if there is a DT_RUNPATH.
+	paths, _ := f.DynString(elf.DT_RUNPATH)
+	if len(paths) == 0 {
+		paths, _ = f.DynString(elf.DT_RPATH)
+	}
+	var dirs []string
+	for _, ps := range paths {
+		for _, d := range strings.Split(ps, ":") {
+			d = strings.ReplaceAll(strings.ReplaceAll(d, "${ORIGIN}", origin), "$ORIGIN", origin)
+			if d != "" {
+				dirs = append(dirs, d)
+			}
+		}
+	}
+	return f, interp, needed, dirs, nil
+}
+
+// sameMachine returns true if the ELF file p is for the machine and
+// class of f.
+func sameMachine(p string, f *elf.File) bool {
+	l, err := elf.Open(p)
+	if err != nil {
+		return false
+	}
+	defer l.Close()
+	return l.Machine == f.Machine && l.Class == f.Class
+}
+
+// sysrootLibs returns the interpreters and shared libraries, in
+// sysroot, of the dynamically linked ELF binaries bins, which map
+// files on the host to their paths in the image. The result maps the
+// paths in the image of the libraries to their files.
+func sysrootLibs(sysroot string, bins map[string]string) (map[string]string, error) {
+	search := append(ldConf(sysroot, "/etc/ld.so.conf", 0), ldDirs...)
+	libs := map[string]string{}
+	type object struct{ host, dest string }
+	var (
+		queue   []object
+		missing []string
+	)
+	for host, dest := range bins {
+		queue = append(queue, object{host, dest})
+	}
+	for len(queue) > 0 {
+		o := queue[0]
+		queue = queue[1:]
+		f, interp, needed, dirs, err := elfDeps(o.host, path.Dir(o.dest))
+		if err != nil {
+			return nil, fmt.Errorf("%q: %v", o.host, err)
+		}
+		if interp != "" && libs[interp] == "" {
+			host, err := resolveIn(sysroot, interp)
+			if err != nil {
+				f.Close()
+				return nil, fmt.Errorf("%q: interpreter: %v", o.host, err)
+			}
+			libs[interp] = host
+		}
+		for _, n := range needed {
+			var ds []string
+			if strings.Contains(n, "/") {
+				ds = []string{""}
+			} else {
+				ds = append(append([]string{}, dirs...), search...)
+			}
+			found := false
+			for _, d := range ds {
+				dest := path.Clean("/" + path.Join(d, n))
+				if libs[dest] != "" {
+					found = true
+					break
+				}
+				host, err := resolveIn(sysroot, dest)
+				if err != nil || !sameMachine(host, f) {
+					continue
+				}
+				V("files: %q from %q, for %q", dest, host, o.host)
+				libs[dest] = host
+				queue = append(queue, object{host, dest})
+				found = true
+				break
+			}
+			if !found {
+				missing = append(missing, fmt.Sprintf("%s (for %s)", n, o.dest))
+			}
+		}
+		f.Close()
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("not in %q: %q", sysroot, missing)
+	}
+	return libs, nil
+}
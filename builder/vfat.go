@@ -0,0 +1,746 @@
+// Copyright 2022 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package builder
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// This file writes a FAT32 file system image from a tree, with no help
+// from mkfs.vfat, loop devices, or root. Everything is laid out up front:
+// each file and directory gets a contiguous run of clusters, so the
+// FAT is just a set of chains i -> i+1.
+
+const (
+	sectorSize   = 512
+	clusterSecs  = 8
+	clusterSize  = sectorSize * clusterSecs
+	reservedSecs = 32
+	numFATs      = 2
+	// FAT32 needs at least this many clusters, or it is FAT16.
+	minClusters = 65525
+	// Partitioned images start the file system at 1MiB.
+	partStart = 2048
+	// Sectors at the end of the disk for the backup GPT.
+	gptBackupSecs = 33
+	dirEntSize    = 32
+	fatEOC        = 0x0fffffff
+	attrVolume    = 0x08
+	attrDir       = 0x10
+	attrArchive   = 0x20
+	attrLFN       = 0x0f
+	lfnChars      = 13
+	volumeLabel   = "SOURCERY   "
+)
+
+// Partition table types for -vfatpart.
+const (
+	partNone = "none"
+	partMBR  = "mbr"
+	partGPT  = "gpt"
+)
+
+// fatNode is a file or directory to be placed in the image.
+type fatNode struct {
+	name     string
+	path     string
+	dir      bool
+	size     int64
+	mtime    time.Time
+	children []*fatNode
+	short    [11]byte
+	cluster  uint32
+	clusters uint32
+}
+
+// entries returns the number of directory entries n needs in its parent.
+func (n *fatNode) entries() int {
+	return 1 + (len(utf16.Encode([]rune(n.name)))+lfnChars-1)/lfnChars
+}
+
+// dirSize returns the number of bytes in directory n.
+// Directories other than the root have . and .. entries;
+// the root has the volume label instead.
+func (n *fatNode) dirSize(root bool) int64 {
+	e := 2
+	if root {
+		e = 1
+	}
+	for _, c := range n.children {
+		e += c.entries()
+	}
+	// Leave room for an end of directory entry.
+	return int64(e+1) * dirEntSize
+}
+
+func clustersFor(size int64) uint32 {
+	return uint32((size + clusterSize - 1) / clusterSize)
+}
+
+// fatTree reads fsys into a tree of fatNodes. FAT has no symlinks, so
+// a symlink gets a copy of what it points at, which must be in the
+// tree; special files have no FAT equivalent and are skipped.
+func fatTree(fsys fs.FS) (*fatNode, error) {
+	root := &fatNode{path: ".", dir: true}
+	return root, fatDir(fsys, root, map[string]bool{".": true})
+}
+
+// fatDir adds the entries of directory d, and those below it, to d.
+// active are the directories being read, to catch symlink loops.
+func fatDir(fsys fs.FS, d *fatNode, active map[string]bool) error {
+	ents, err := fs.ReadDir(fsys, d.path)
+	if err != nil {
+		return err
+	}
+	for _, e := range ents {
+		p := path.Join(d.path, e.Name())
+		t := e.Type()
+		switch {
+		case t&fs.ModeSymlink != 0:
+			r, err := resolveFS(fsys, p)
+			if err != nil {
+				return fmt.Errorf("%q: %v", p, err)
+			}
+			V("vfat: %q is a copy of %q", p, r)
+			p = r
+		case t&^fs.ModeDir != 0:
+			V("vfat: skipping %q, type %v", p, t)
+			continue
+		}
+		fi, err := fs.Stat(fsys, p)
+		if err != nil {
+			return err
+		}
+		n := &fatNode{name: e.Name(), path: p, dir: fi.IsDir(), mtime: fi.ModTime()}
+		switch {
+		case n.dir:
+			if active[p] {
+				return fmt.Errorf("%q: symlink loop", path.Join(d.path, e.Name()))
+			}
+			active[p] = true
+			err := fatDir(fsys, n, active)
+			delete(active, p)
+			if err != nil {
+				return err
+			}
+		case fi.Mode().IsRegular():
+			n.size = fi.Size()
+			if n.size > 0xffffffff {
+				return fmt.Errorf("%q: %d bytes is too big for FAT", p, n.size)
+			}
+		default:
+			V("vfat: skipping %q, type %v", p, fi.Mode().Type())
+			continue
+		}
+		d.children = append(d.children, n)
+	}
+	return nil
+}
+
+// lmode returns the type of p in fsys, not following symlinks.
+func lmode(fsys fs.FS, p string) (fs.FileMode, error) {
+	if p == "." {
+		return fs.ModeDir, nil
+	}
+	ents, err := fs.ReadDir(fsys, path.Dir(p))
+	if err != nil {
+		return 0, err
+	}
+	for _, e := range ents {
+		if e.Name() == path.Base(p) {
+			return e.Type(), nil
+		}
+	}
+	return 0, &fs.PathError{Op: "lstat", Path: p, Err: fs.ErrNotExist}
+}
+
+// resolveFS returns p, in fsys, with its symlinks resolved. Absolute
+// targets are from the root of fsys, as they are in the image; targets
+// outside it are errors.
+func resolveFS(fsys fs.FS, p string) (string, error) {
+	for n := 0; n < maxLinks; n++ {
+		parts := strings.Split(p, "/")
+		link := false
+		for i := range parts {
+			cur := path.Join(parts[:i+1]...)
+			m, err := lmode(fsys, cur)
+			if err != nil {
+				return "", err
+			}
+			if m&fs.ModeSymlink == 0 {
+				continue
+			}
+			t, err := readLink(fsys, cur)
+			if err != nil {
+				return "", err
+			}
+			if path.IsAbs(t) {
+				t = path.Join(".", strings.TrimPrefix(path.Clean(t), "/"))
+			} else {
+				t = path.Join(path.Dir(cur), t)
+			}
+			if t == ".." || strings.HasPrefix(t, "../") {
+				return "", fmt.Errorf("%q points outside the tree", cur)
+			}
+			p, link = path.Join(append([]string{t}, parts[i+1:]...)...), true
+			break
+		}
+		if !link {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("too many symlinks")
+}
+
+// checkCase returns an error if two children of d, or of a directory
+// below it, have names that differ only in case: FAT looks names up
+// without regard to case, so one of them could not be found.
+func checkCase(d *fatNode) error {
+	seen := map[string]string{}
+	for _, c := range d.children {
+		k := strings.ToUpper(c.name)
+		if o, ok := seen[k]; ok {
+			return fmt.Errorf("%q and %q differ only in case, which FAT can not tell apart", o, c.path)
+		}
+		seen[k] = c.path
+		if c.dir {
+			if err := checkCase(c); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// shortChars are the characters, other than letters and digits,
+// that may appear in an 8.3 name.
+const shortChars = "!#$%&'()-@^_`{}~"
+
+func shortClean(s string, max int) string {
+	var b strings.Builder
+	for _, r := range strings.ToUpper(s) {
+		if b.Len() == max {
+			break
+		}
+		switch {
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', strings.ContainsRune(shortChars, r):
+			b.WriteRune(r)
+		case r == ' ', r == '.':
+		default:
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+// shortNames gives every child of d a unique 8.3 name.
+// Every entry also gets a long name, so these only need to be
+// unique and valid, which is what NAME~N.EXT gets us.
+func shortNames(d *fatNode) {
+	used := map[string]bool{}
+	for _, c := range d.children {
+		base, ext := c.name, ""
+		if i := strings.LastIndex(c.name, "."); i > 0 {
+			base, ext = c.name[:i], c.name[i+1:]
+		}
+		base, ext = shortClean(base, 8), shortClean(ext, 3)
+		if base == "" {
+			base = "_"
+		}
+		for i := 1; ; i++ {
+			tail := fmt.Sprintf("~%d", i)
+			b := base
+			if len(b)+len(tail) > 8 {
+				b = b[:8-len(tail)]
+			}
+			n := fmt.Sprintf("%-8s%-3s", b+tail, ext)
+			if !used[n] {
+				used[n] = true
+				copy(c.short[:], n)
+				break
+			}
+		}
+		if c.dir {
+			shortNames(c)
+		}
+	}
+}
+
+// allocate assigns contiguous clusters to d and everything below it,
+// starting at next, and returns the next free cluster.
+func allocate(d *fatNode, next uint32, root bool) uint32 {
+	d.clusters = clustersFor(d.dirSize(root))
+	d.cluster, next = next, next+d.clusters
+	for _, c := range d.children {
+		if c.dir {
+			next = allocate(c, next, false)
+			continue
+		}
+		if c.clusters = clustersFor(c.size); c.clusters > 0 {
+			c.cluster, next = next, next+c.clusters
+		}
+	}
+	return next
+}
+
+func dosTime(t time.Time) (uint16, uint16) {
+	if t.Year() < 1980 {
+		t = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	date := uint16((t.Year()-1980)<<9 | int(t.Month())<<5 | t.Day())
+	tm := uint16(t.Hour()<<11 | t.Minute()<<5 | t.Second()/2)
+	return date, tm
+}
+
+func shortEntry(name [11]byte, attr byte, cluster uint32, size uint32, mtime time.Time) []byte {
+	e := make([]byte, dirEntSize)
+	copy(e, name[:])
+	e[11] = attr
+	date, tm := dosTime(mtime)
+	binary.LittleEndian.PutUint16(e[14:], tm)
+	binary.LittleEndian.PutUint16(e[16:], date)
+	binary.LittleEndian.PutUint16(e[18:], date)
+	binary.LittleEndian.PutUint16(e[20:], uint16(cluster>>16))
+	binary.LittleEndian.PutUint16(e[22:], tm)
+	binary.LittleEndian.PutUint16(e[24:], date)
+	binary.LittleEndian.PutUint16(e[26:], uint16(cluster))
+	binary.LittleEndian.PutUint32(e[28:], size)
+	return e
+}
+
+func lfnChecksum(short [11]byte) byte {
+	var sum byte
+	for _, c := range short {
+		sum = (sum&1)<<7 + sum>>1 + c
+	}
+	return sum
+}
+
+// lfnEntries returns the long file name entries for n,
+// in the order they go on disk, i.e. last part first.
+func lfnEntries(n *fatNode) []byte {
+	u := utf16.Encode([]rune(n.name))
+	count := (len(u) + lfnChars - 1) / lfnChars
+	// Terminate with a 0, then pad with 0xffff.
+	if len(u)%lfnChars != 0 {
+		u = append(u, 0)
+	}
+	for len(u)%lfnChars != 0 {
+		u = append(u, 0xffff)
+	}
+	sum := lfnChecksum(n.short)
+	var b []byte
+	for i := count; i > 0; i-- {
+		e := make([]byte, dirEntSize)
+		e[0] = byte(i)
+		if i == count {
+			e[0] |= 0x40
+		}
+		e[11] = attrLFN
+		e[13] = sum
+		part := u[(i-1)*lfnChars : i*lfnChars]
+		for j, off := range []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30} {
+			binary.LittleEndian.PutUint16(e[off:], part[j])
+		}
+		b = append(b, e...)
+	}
+	return b
+}
+
+// dirBytes returns the contents of directory d, whose parent
+// directory starts at cluster parent.
+func dirBytes(d *fatNode, parent uint32, root bool) []byte {
+	var b []byte
+	if root {
+		var label [11]byte
+		copy(label[:], volumeLabel)
+		b = append(b, shortEntry(label, attrVolume, 0, 0, d.mtime)...)
+	} else {
+		var dot, dotdot [11]byte
+		copy(dot[:], ".          ")
+		copy(dotdot[:], "..         ")
+		b = append(b, shortEntry(dot, attrDir, d.cluster, 0, d.mtime)...)
+		b = append(b, shortEntry(dotdot, attrDir, parent, 0, d.mtime)...)
+	}
+	for _, c := range d.children {
+		b = append(b, lfnEntries(c)...)
+		attr, size := byte(attrArchive), uint32(c.size)
+		if c.dir {
+			attr, size = attrDir, 0
+		}
+		b = append(b, shortEntry(c.short, attr, c.cluster, size, c.mtime)...)
+	}
+	return b
+}
+
+// offsetWriter writes sequentially to an io.WriterAt.
+type offsetWriter struct {
+	w   io.WriterAt
+	off int64
+}
+
+func (o *offsetWriter) Write(b []byte) (int, error) {
+	n, err := o.w.WriteAt(b, o.off)
+	o.off += int64(n)
+	return n, err
+}
+
+// fatLayout describes where things are in the file system.
+type fatLayout struct {
+	offset   int64 // of the file system in the image, in bytes
+	sectors  uint32
+	fatSecs  uint32
+	clusters uint32
+}
+
+func newFATLayout(offset int64, sectors uint32) fatLayout {
+	// This is the FAT size computation from the Microsoft FAT spec.
+	tmp1 := sectors - reservedSecs
+	tmp2 := uint32(256*clusterSecs+numFATs) / 2
+	fatSecs := (tmp1 + tmp2 - 1) / tmp2
+	return fatLayout{
+		offset:   offset,
+		sectors:  sectors,
+		fatSecs:  fatSecs,
+		clusters: (sectors - reservedSecs - numFATs*fatSecs) / clusterSecs,
+	}
+}
+
+// clusterOffset returns the byte offset of cluster c in the image.
+func (l fatLayout) clusterOffset(c uint32) int64 {
+	return l.offset + int64(reservedSecs+numFATs*l.fatSecs)*sectorSize + int64(c-2)*clusterSize
+}
+
+// imageSectors returns the size of an image that can hold used clusters,
+// with some room to spare, and at least the FAT32 minimum.
+func imageSectors(used uint32, part string) int64 {
+	c := int64(used) + int64(used)/20 + 1024
+	if c < minClusters+1024 {
+		c = minClusters + 1024
+	}
+	fatSecs := (c*4 + sectorSize - 1) / sectorSize
+	s := reservedSecs + numFATs*fatSecs + c*clusterSecs
+	if part != partNone {
+		s += partStart + gptBackupSecs
+	}
+	// Round up to a MiB.
+	return (s + 2047) &^ 2047
+}
+
+func (l fatLayout) bootSector(volID uint32) []byte {
+	b := make([]byte, sectorSize)
+	copy(b, []byte{0xeb, 0x58, 0x90})
+	copy(b[3:], "SOURCERY")
+	binary.LittleEndian.PutUint16(b[11:], sectorSize)
+	b[13] = clusterSecs
+	binary.LittleEndian.PutUint16(b[14:], reservedSecs)
+	b[16] = numFATs
+	b[21] = 0xf8
+	binary.LittleEndian.PutUint16(b[24:], 63)
+	binary.LittleEndian.PutUint16(b[26:], 255)
+	binary.LittleEndian.PutUint32(b[28:], uint32(l.offset/sectorSize))
+	binary.LittleEndian.PutUint32(b[32:], l.sectors)
+	binary.LittleEndian.PutUint32(b[36:], l.fatSecs)
+	binary.LittleEndian.PutUint32(b[44:], 2)
+	binary.LittleEndian.PutUint16(b[48:], 1)
+	binary.LittleEndian.PutUint16(b[50:], 6)
+	b[64] = 0x80
+	b[66] = 0x29
+	binary.LittleEndian.PutUint32(b[67:], volID)
+	copy(b[71:], volumeLabel)
+	copy(b[82:], "FAT32   ")
+	b[510], b[511] = 0x55, 0xaa
+	return b
+}
+
+func (l fatLayout) fsInfo(free, next uint32) []byte {
+	b := make([]byte, sectorSize)
+	binary.LittleEndian.PutUint32(b[0:], 0x41615252)
+	binary.LittleEndian.PutUint32(b[484:], 0x61417272)
+	binary.LittleEndian.PutUint32(b[488:], free)
+	binary.LittleEndian.PutUint32(b[492:], next)
+	binary.LittleEndian.PutUint32(b[508:], 0xaa550000)
+	return b
+}
+
+// mbr returns a master boot record with disk signature id and one
+// entry of type typ covering sectors [start, start+count).
+func mbr(id uint32, typ byte, boot bool, start, count uint32) []byte {
+	b := make([]byte, sectorSize)
+	binary.LittleEndian.PutUint32(b[440:], id)
+	e := b[446:]
+	if boot {
+		e[0] = 0x80
+	}
+	// CHS addresses are meaningless at these sizes; use the
+	// "use LBA" values everyone else does.
+	copy(e[1:4], []byte{0xfe, 0xff, 0xff})
+	e[4] = typ
+	copy(e[5:8], []byte{0xfe, 0xff, 0xff})
+	binary.LittleEndian.PutUint32(e[8:], start)
+	binary.LittleEndian.PutUint32(e[12:], count)
+	b[510], b[511] = 0x55, 0xaa
+	return b
+}
+
+// espType is the EFI System Partition type GUID, which firmware
+// looks for when it searches for EFI/BOOT.
+var espType = guid("c12a7328-f81f-11d2-ba4b-00a0c93ec93b")
+
+// guid returns the mixed-endian on-disk form of the GUID s.
+func guid(s string) []byte {
+	var b [16]byte
+	h := strings.ReplaceAll(s, "-", "")
+	for i := range b {
+		fmt.Sscanf(h[2*i:2*i+2], "%02x", &b[i])
+	}
+	b[0], b[1], b[2], b[3] = b[3], b[2], b[1], b[0]
+	b[4], b[5] = b[5], b[4]
+	b[6], b[7] = b[7], b[6]
+	return b[:]
+}
+
+// derivedGUID returns a version 4 style GUID derived from seed,
+// so that images are reproducible.
+func derivedGUID(seed string) []byte {
+	h := sha256.Sum256([]byte(seed))
+	h[7] = h[7]&0x0f | 0x40
+	h[8] = h[8]&0x3f | 0x80
+	return h[:16]
+}
+
+// guidString returns the usual text form of the on-disk GUID b.
+func guidString(b []byte) string {
+	return fmt.Sprintf("%08x-%04x-%04x-%x-%x",
+		binary.LittleEndian.Uint32(b[0:]),
+		binary.LittleEndian.Uint16(b[4:]),
+		binary.LittleEndian.Uint16(b[6:]),
+		b[8:10], b[10:16])
+}
+
+// partGUID returns the GUID of the partition in GPT images with disk id.
+func partGUID(id uint32) []byte {
+	return derivedGUID(fmt.Sprintf("sourcery part %08x", id))
+}
+
+// partUUID returns what the kernel calls the PARTUUID of the file
+// system in an image with partition table part and disk id,
+// or "" if there is no partition table.
+func partUUID(part string, id uint32) string {
+	switch part {
+	case partMBR:
+		return fmt.Sprintf("%08x-01", id)
+	case partGPT:
+		return guidString(partGUID(id))
+	}
+	return ""
+}
+
+// gpt writes a protective MBR, and primary and backup GPTs with one
+// EFI System Partition covering sectors [start, start+count), to w,
+// an image of total sectors.
+func gpt(w io.WriterAt, id uint32, total int64, start, count uint32) error {
+	if _, err := w.WriteAt(mbr(0, 0xee, false, 1, uint32(total-1)), 0); err != nil {
+		return err
+	}
+	entries := make([]byte, 128*128)
+	copy(entries[0:], espType)
+	copy(entries[16:], partGUID(id))
+	binary.LittleEndian.PutUint64(entries[32:], uint64(start))
+	binary.LittleEndian.PutUint64(entries[40:], uint64(start)+uint64(count)-1)
+	for i, r := range utf16.Encode([]rune("sourcery")) {
+		binary.LittleEndian.PutUint16(entries[56+2*i:], r)
+	}
+	entriesCRC := crc32.ChecksumIEEE(entries)
+	disk := derivedGUID(fmt.Sprintf("sourcery disk %08x", id))
+
+	header := func(cur, backup, entLBA int64) []byte {
+		h := make([]byte, sectorSize)
+		copy(h, "EFI PART")
+		binary.LittleEndian.PutUint32(h[8:], 0x00010000)
+		binary.LittleEndian.PutUint32(h[12:], 92)
+		binary.LittleEndian.PutUint64(h[24:], uint64(cur))
+		binary.LittleEndian.PutUint64(h[32:], uint64(backup))
+		binary.LittleEndian.PutUint64(h[40:], 34)
+		binary.LittleEndian.PutUint64(h[48:], uint64(total-gptBackupSecs-1))
+		copy(h[56:], disk)
+		binary.LittleEndian.PutUint64(h[72:], uint64(entLBA))
+		binary.LittleEndian.PutUint32(h[80:], 128)
+		binary.LittleEndian.PutUint32(h[84:], 128)
+		binary.LittleEndian.PutUint32(h[88:], entriesCRC)
+		binary.LittleEndian.PutUint32(h[16:], crc32.ChecksumIEEE(h[:92]))
+		return h
+	}
+	for _, x := range []struct {
+		off int64
+		dat []byte
+	}{
+		{1, header(1, total-1, 2)},
+		{2, entries},
+		{total - gptBackupSecs, entries},
+		{total - 1, header(total-1, 1, total-gptBackupSecs)},
+	} {
+		if _, err := w.WriteAt(x.dat, x.off*sectorSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// vfat writes a FAT32 image of fsys to out. The image has size bytes,
+// or is sized to fit if size is 0. part is the partition table to
+// write: none, mbr, or gpt. The volume, disk and partition identifiers
+// are all derived from id, so boot configurations can name the
+// partition before the image exists.
+func vfat(fsys fs.FS, out string, size int64, part string, id uint32) error {
+	switch part {
+	case partNone, partMBR, partGPT:
+	default:
+		return fmt.Errorf("unknown partition table %q: want %q, %q or %q", part, partNone, partMBR, partGPT)
+	}
+	root, err := fatTree(fsys)
+	if err != nil {
+		return err
+	}
+	// Keep the image independent of walk order.
+	var sortTree func(d *fatNode)
+	sortTree = func(d *fatNode) {
+		sort.Slice(d.children, func(i, j int) bool { return d.children[i].name < d.children[j].name })
+		for _, c := range d.children {
+			if c.dir {
+				sortTree(c)
+			}
+		}
+	}
+	sortTree(root)
+	if err := checkCase(root); err != nil {
+		return err
+	}
+	shortNames(root)
+	next := allocate(root, 2, true)
+	used := next - 2
+
+	total := size / sectorSize
+	if total == 0 {
+		total = imageSectors(used, part)
+	}
+	fsStart, fsSecs := int64(0), total
+	if part != partNone {
+		fsStart, fsSecs = partStart, total-partStart
+		if part == partGPT {
+			fsSecs -= gptBackupSecs
+		}
+	}
+	if fsSecs <= 0 || fsSecs > 0xffffffff {
+		return fmt.Errorf("image size %d bytes is out of range", size)
+	}
+	l := newFATLayout(fsStart*sectorSize, uint32(fsSecs))
+	if l.clusters < minClusters {
+		return fmt.Errorf("image of %d bytes has %d clusters, FAT32 needs %d", total*sectorSize, l.clusters, minClusters)
+	}
+	if used > l.clusters {
+		return fmt.Errorf("tree needs %d clusters, image of %d bytes only has %d", used, total*sectorSize, l.clusters)
+	}
+	V("vfat: %d sectors, file system at sector %d, %d of %d clusters used", total, fsStart, used, l.clusters)
+
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Truncate(total * sectorSize); err != nil {
+		return err
+	}
+
+	switch part {
+	case partMBR:
+		// 0x0c is FAT32 with LBA addressing.
+		if _, err := f.WriteAt(mbr(id, 0x0c, true, uint32(fsStart), uint32(fsSecs)), 0); err != nil {
+			return err
+		}
+	case partGPT:
+		if err := gpt(f, id, total, uint32(fsStart), uint32(fsSecs)); err != nil {
+			return err
+		}
+	}
+
+	boot := l.bootSector(id)
+	info := l.fsInfo(l.clusters-used, next)
+	for _, x := range []struct {
+		sec int64
+		dat []byte
+	}{{0, boot}, {1, info}, {6, boot}, {7, info}} {
+		if _, err := f.WriteAt(x.dat, l.offset+x.sec*sectorSize); err != nil {
+			return err
+		}
+	}
+
+	fat := make([]byte, l.fatSecs*sectorSize)
+	binary.LittleEndian.PutUint32(fat[0:], 0x0ffffff8)
+	binary.LittleEndian.PutUint32(fat[4:], fatEOC)
+	var walk func(d *fatNode, parent uint32, root bool) error
+	chain := func(n *fatNode) {
+		for i := uint32(0); i < n.clusters; i++ {
+			c, v := n.cluster+i, n.cluster+i+1
+			if i == n.clusters-1 {
+				v = fatEOC
+			}
+			binary.LittleEndian.PutUint32(fat[4*c:], v)
+		}
+	}
+	walk = func(d *fatNode, parent uint32, root bool) error {
+		chain(d)
+		if _, err := f.WriteAt(dirBytes(d, parent, root), l.clusterOffset(d.cluster)); err != nil {
+			return err
+		}
+		// The .. entry uses 0 for the root directory.
+		self := d.cluster
+		if root {
+			self = 0
+		}
+		for _, c := range d.children {
+			if c.dir {
+				if err := walk(c, self, false); err != nil {
+					return err
+				}
+				continue
+			}
+			if c.clusters == 0 {
+				continue
+			}
+			chain(c)
+			src, err := fsys.Open(c.path)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(&offsetWriter{f, l.clusterOffset(c.cluster)}, io.LimitReader(src, c.size))
+			src.Close()
+			if err != nil {
+				return fmt.Errorf("%q: %v", c.path, err)
+			}
+		}
+		return nil
+	}
+	if err := walk(root, 0, true); err != nil {
+		return err
+	}
+	for i := int64(0); i < numFATs; i++ {
+		if _, err := f.WriteAt(fat, l.offset+(reservedSecs+i*int64(l.fatSecs))*sectorSize); err != nil {
+			return err
+		}
+	}
+	return f.Close()
+}
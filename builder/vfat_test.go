@@ -0,0 +1,212 @@
+// Copyright 2022 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package builder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+	"unicode/utf16"
+)
+
+func TestShortNames(t *testing.T) {
+	d := &fatNode{dir: true}
+	for _, n := range []string{"go.mod", "go.sum", "Go.mod", "README.md", ".git", "a_very_long_name.golang", "x"} {
+		d.children = append(d.children, &fatNode{name: n})
+	}
+	shortNames(d)
+	seen := map[[11]byte]string{}
+	for _, c := range d.children {
+		if o, ok := seen[c.short]; ok {
+			t.Errorf("%q and %q both have short name %q", o, c.name, c.short)
+		}
+		seen[c.short] = c.name
+	}
+}
+
+func TestVFAT(t *testing.T) {
+	fsys := fstest.MapFS{
+		"go/VERSION":              {Data: []byte("go1.17.7"), Mode: 0644},
+		"linux_amd64/bin/init":    {Data: make([]byte, 3*clusterSize+1), Mode: 0755},
+		"src/github.com/u-root/x": {Data: nil, Mode: 0644},
+		"etc":                     {Mode: os.ModeDir | 0755},
+		"A Long Name With Spaces": {Data: []byte("hi"), Mode: 0644},
+	}
+	for _, part := range []string{partNone, partMBR, partGPT} {
+		img := filepath.Join(t.TempDir(), "img")
+		if err := vfat(fsys, img, 0, part, 0x5ca1ab1e); err != nil {
+			t.Fatalf("vfat(%q): %v", part, err)
+		}
+		dat, err := os.ReadFile(img)
+		if err != nil {
+			t.Fatal(err)
+		}
+		off := 0
+		if part != partNone {
+			off = partStart * sectorSize
+		}
+		bs := dat[off : off+sectorSize]
+		if string(bs[82:90]) != "FAT32   " || bs[510] != 0x55 || bs[511] != 0xaa {
+			t.Errorf("%q: bad boot sector %q", part, bs)
+		}
+		l := newFATLayout(int64(off), binary.LittleEndian.Uint32(bs[32:]))
+		if l.clusters < minClusters {
+			t.Errorf("%q: %d clusters, want at least %d", part, l.clusters, minClusters)
+		}
+	}
+	if err := vfat(fsys, filepath.Join(t.TempDir(), "img"), 1<<20, partNone, 0); err == nil {
+		t.Errorf("vfat with a 1MiB image: got nil, want error")
+	}
+	fsys["etc/README"] = &fstest.MapFile{Data: []byte("a"), Mode: 0644}
+	fsys["etc/readme"] = &fstest.MapFile{Data: []byte("b"), Mode: 0644}
+	if err := vfat(fsys, filepath.Join(t.TempDir(), "img"), 0, partNone, 0); err == nil {
+		t.Errorf("vfat with etc/README and etc/readme: got nil, want error")
+	}
+}
+
+// fatEnt is what the test reads back of a directory entry.
+type fatEnt struct {
+	dir           bool
+	cluster, size uint32
+}
+
+// fatImage reads back a FAT32 file system at the start of img.
+type fatImage struct {
+	img []byte
+	l   fatLayout
+	fat []byte
+}
+
+func newFATImage(img []byte) *fatImage {
+	l := newFATLayout(0, binary.LittleEndian.Uint32(img[32:]))
+	off := reservedSecs * sectorSize
+	return &fatImage{img: img, l: l, fat: img[off : off+int(l.fatSecs)*sectorSize]}
+}
+
+// data returns the contents of the cluster chain starting at c, cut
+// to size if it is not 0.
+func (f *fatImage) data(c, size uint32) []byte {
+	var b []byte
+	for c >= 2 && c < fatEOC&^7 {
+		o := f.l.clusterOffset(c)
+		b = append(b, f.img[o:o+clusterSize]...)
+		c = binary.LittleEndian.Uint32(f.fat[4*c:])
+	}
+	if size != 0 {
+		b = b[:size]
+	}
+	return b
+}
+
+// dir returns the entries, but . and .., of the directory at cluster
+// c, by long name.
+func (f *fatImage) dir(c uint32) map[string]fatEnt {
+	ents := map[string]fatEnt{}
+	var lfn []uint16
+	dat := f.data(c, 0)
+	for i := 0; i+dirEntSize <= len(dat) && dat[i] != 0; i += dirEntSize {
+		e := dat[i : i+dirEntSize]
+		if e[11] == attrLFN {
+			var part []uint16
+			for _, off := range []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30} {
+				part = append(part, binary.LittleEndian.Uint16(e[off:]))
+			}
+			// Parts are last first.
+			lfn = append(part, lfn...)
+			continue
+		}
+		if e[11]&attrVolume != 0 || e[0] == '.' {
+			lfn = nil
+			continue
+		}
+		for j, u := range lfn {
+			if u == 0 {
+				lfn = lfn[:j]
+				break
+			}
+		}
+		name := string(utf16.Decode(lfn))
+		lfn = nil
+		ents[name] = fatEnt{
+			dir:     e[11]&attrDir != 0,
+			cluster: uint32(binary.LittleEndian.Uint16(e[20:]))<<16 | uint32(binary.LittleEndian.Uint16(e[26:])),
+			size:    binary.LittleEndian.Uint32(e[28:]),
+		}
+	}
+	return ents
+}
+
+// lookup returns the entry for p.
+func (f *fatImage) lookup(t *testing.T, p string) fatEnt {
+	t.Helper()
+	e := fatEnt{dir: true, cluster: 2}
+	for _, n := range strings.Split(p, "/") {
+		if !e.dir {
+			t.Fatalf("%q: %q is not a directory", p, n)
+		}
+		var ok bool
+		if e, ok = f.dir(e.cluster)[n]; !ok {
+			t.Fatalf("%q: no %q", p, n)
+		}
+	}
+	return e
+}
+
+func TestVFATContents(t *testing.T) {
+	const long = "A Long Name With Spaces, Longer Than Thirteen.txt"
+	big := bytes.Repeat([]byte("0123456789abcdef"), 3*clusterSize/16+1)
+	img := newOverlay(t.TempDir(), time.Time{})
+	img.WriteFile("bin/flashrom", big, 0755)
+	img.WriteFile("lib/libc-2.so", []byte("libc"), 0755)
+	img.WriteFile(long, []byte("hi"), 0644)
+	img.Symlink("libc-2.so", "lib/libc.so.6")
+	img.Symlink("/lib", "lib64")
+
+	out := filepath.Join(t.TempDir(), "img")
+	if err := vfat(img, out, 0, partNone, 0); err != nil {
+		t.Fatal(err)
+	}
+	dat, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := newFATImage(dat)
+	for p, want := range map[string][]byte{
+		"bin/flashrom":    big,
+		"lib/libc.so.6":   []byte("libc"),
+		"lib64/libc.so.6": []byte("libc"),
+		long:              []byte("hi"),
+	} {
+		e := f.lookup(t, p)
+		if e.dir || e.size != uint32(len(want)) {
+			t.Errorf("%q: got %+v, want a file of %d bytes", p, e, len(want))
+			continue
+		}
+		if got := f.data(e.cluster, e.size); !bytes.Equal(got, want) {
+			t.Errorf("%q: got %d bytes, %q..., want %q...", p, len(got), got[:4], want[:4])
+		}
+	}
+	if e := f.lookup(t, "lib64"); !e.dir {
+		t.Errorf("lib64: got %+v, want a directory", e)
+	}
+
+	for link, target := range map[string]string{
+		"lib/out":  "../../etc/passwd",
+		"lib/loop": "..",
+		"lib/none": "nothing",
+	} {
+		bad := newOverlay(t.TempDir(), time.Time{})
+		bad.WriteFile("lib/libc-2.so", []byte("libc"), 0755)
+		bad.Symlink(target, link)
+		if err := vfat(bad, filepath.Join(t.TempDir(), "img"), 0, partNone, 0); err == nil {
+			t.Errorf("vfat with %q -> %q: got nil, want error", link, target)
+		}
+	}
+}
@@ -12,10 +12,10 @@ require (
 require (
 	github.com/dustin/go-humanize v1.0.0 // indirect
 	github.com/hashicorp/errwrap v1.0.0 // indirect
-	github.com/klauspost/compress v1.10.6 // indirect
+	github.com/klauspost/compress v1.10.6
 	github.com/klauspost/pgzip v1.2.4 // indirect
 	github.com/pierrec/lz4/v4 v4.1.11 // indirect
-	github.com/ulikunitz/xz v0.5.8 // indirect
+	github.com/ulikunitz/xz v0.5.8
 	github.com/vishvananda/netlink v1.1.1-0.20211118161826-650dca95af54
 	github.com/vishvananda/netns v0.0.0-20210104183010-2eb08e3e575f // indirect
 )
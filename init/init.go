@@ -57,6 +57,9 @@ func main() {
 		quiet()
 	}
 
+	// Before anything is mounted over it, check the image.
+	verifyImage()
+
 	SetEnv()
 	CreateRootfs()
 	NetInit()
@@ -38,8 +38,11 @@ func osInitGo() *initCmds {
 
 	// Install modules before exec-ing into user mode below
 	// the install all modules is just done wrong. Ignore for now.
-	// fix later.
-	// InstallAllModules()
+	// fix later. Those sourcery installed, though, are listed in
+	// the order to load them.
+	if _, err := os.Stat(moduleList); err == nil {
+		InstallAllModules()
+	}
 
 	// systemd is "special". If we are supposed to run systemd, we're
 	// going to exec, and if we're going to exec, we're done here.
@@ -75,8 +78,8 @@ func osInitGo() *initCmds {
 			// has a /init. The name inito means "original /init" There may
 			// be an inito if we are building on an existing initramfs. All
 			// initos need their own pid space.
+			Command("/inito", WithCloneFlags(syscall.CLONE_NEWPID), ctty),
 			Command("elvish"),
-			//Command("inito", WithCloneFlags(syscall.CLONE_NEWPID), ctty),
 			//Command("uinit", ctty, uinitArgs),
 			Command("defaultsh", ctty),
 			Command("sh", ctty),
@@ -243,17 +243,42 @@ var excludedMods = map[string]bool{
 	"idpf_imc": true,
 }
 
+// moduleList lists the kernel modules sourcery installed for this
+// target, in the order to load them.
+var moduleList = fmt.Sprintf("/%s_%s/lib/modules/modules.load", runtime.GOOS, runtime.GOARCH)
+
 // InstallAllModules installs kernel modules (.ko files) from /lib/modules.
 // Useful for modules that need to be loaded for boot (ie a network
 // driver needed for netboot). It skips over blacklisted modules in
-// excludedMods.
+// excludedMods. If there is a moduleList, it installs the modules it
+// names instead.
 func InstallAllModules() {
+	if _, err := os.Stat(moduleList); err == nil {
+		if err := InstallModuleList(moduleList, excludedMods); err != nil {
+			log.Print(err)
+		}
+		return
+	}
 	modulePattern := "/lib/modules/*.ko"
 	if err := InstallModules(modulePattern, excludedMods); err != nil {
 		log.Print(err)
 	}
 }
 
+// InstallModuleList installs the kernel modules named in the file list,
+// one per line, in order, from the directory it is in, skipping those in
+// the exclude list.
+func InstallModuleList(list string, exclude map[string]bool) error {
+	dat, err := os.ReadFile(list)
+	if err != nil {
+		return err
+	}
+	for _, n := range strings.Fields(string(dat)) {
+		installModule(filepath.Join(filepath.Dir(list), n), exclude)
+	}
+	return nil
+}
+
 // InstallModules installs kernel modules (.ko files) from /lib/modules that
 // match the given pattern, skipping those in the exclude list.
 func InstallModules(pattern string, exclude map[string]bool) error {
@@ -266,26 +291,31 @@ func InstallModules(pattern string, exclude map[string]bool) error {
 	}
 
 	for _, filename := range files {
-		f, err := os.Open(filename)
-		if err != nil {
-			log.Printf("installModules: can't open %q: %v", filename, err)
-			continue
-		}
-		// Module flags are passed to the command line in the form modulename.flag=val
-		// And must be passed to FileInit as flag=val to be installed properly
-		moduleName := strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
-		if _, ok := exclude[moduleName]; ok {
-			log.Printf("Skipping module %s", moduleName)
-			continue
-		}
-
-		flags := cmdline.FlagsForModule(moduleName)
-		err = kmodule.FileInit(f, flags, 0)
-		f.Close()
-		if err != nil {
-			log.Printf("installModules: can't install %q: %v", filename, err)
-		}
+		installModule(filename, exclude)
 	}
 
 	return nil
 }
+
+// installModule installs the kernel module in filename, unless it is in
+// the exclude list.
+func installModule(filename string, exclude map[string]bool) {
+	f, err := os.Open(filename)
+	if err != nil {
+		log.Printf("installModules: can't open %q: %v", filename, err)
+		return
+	}
+	defer f.Close()
+	// Module flags are passed to the command line in the form modulename.flag=val
+	// And must be passed to FileInit as flag=val to be installed properly
+	moduleName := strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+	if _, ok := exclude[moduleName]; ok {
+		log.Printf("Skipping module %s", moduleName)
+		return
+	}
+
+	flags := cmdline.FlagsForModule(moduleName)
+	if err := kmodule.FileInit(f, flags, 0); err != nil {
+		log.Printf("installModules: can't install %q: %v", filename, err)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2022 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/u-root/sourcery/manifest"
+)
+
+var (
+	// manifestKey is the base64 ed25519 key the image's manifest is
+	// signed with, set by the builder with -ldflags -X. If it is
+	// empty, the image is not checked.
+	manifestKey string
+	// manifestPolicy is what to do if the image does not match:
+	// enforce, refusing to boot, or warn.
+	manifestPolicy = manifest.Enforce
+)
+
+// lazy are the trees of Go sources, which installcommand checks, file
+// by file, before it compiles a command from them. Checking them all at
+// boot would take most of the time.
+var lazy = []string{"go/src/", "src/"}
+
+// checkNow returns the files in m that are checked at boot.
+func checkNow(m manifest.Manifest) []string {
+	var names []string
+	for n := range m {
+		isLazy := false
+		for _, l := range lazy {
+			isLazy = isLazy || strings.HasPrefix(n, l)
+		}
+		if !isLazy {
+			names = append(names, n)
+		}
+	}
+	return names
+}
+
+// verify checks the files in the image at root, but for the sources,
+// against its signed manifest.
+func verify(root string) error {
+	if manifestKey == "" {
+		return nil
+	}
+	key, err := manifest.ParseKey(manifestKey)
+	if err != nil {
+		return err
+	}
+	m, err := manifest.Read(root, key)
+	if err != nil {
+		return err
+	}
+	names := checkNow(m)
+	if len(names) == 0 {
+		return nil
+	}
+	debug("verify: checking %d of %d files", len(names), len(m))
+	if bad := m.Check(root, names...); len(bad) > 0 {
+		n := len(bad)
+		if n > 10 {
+			bad = append(bad[:10], "...")
+		}
+		return fmt.Errorf("%d files do not match the manifest: %q", n, bad)
+	}
+	return nil
+}
+
+// enforce returns err if policy is to refuse to boot on it; otherwise
+// it warns of err, if any, and returns nil.
+func enforce(err error, policy string) error {
+	if err == nil || policy != manifest.Warn {
+		return err
+	}
+	log.Printf("WARNING: image may have been tampered with: %v", err)
+	return nil
+}
+
+// verifyImage checks the image, and, by policy, stops or warns if it
+// does not match its manifest.
+func verifyImage() {
+	if err := enforce(verify("/"), manifestPolicy); err != nil {
+		log.Fatalf("Image may have been tampered with, not booting: %v", err)
+	}
+}
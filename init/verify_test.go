@@ -0,0 +1,79 @@
+// Copyright 2022 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/u-root/sourcery/manifest"
+)
+
+func TestVerify(t *testing.T) {
+	d := t.TempDir()
+	for n, s := range map[string]string{
+		"linux_amd64/bin/init": "init",
+		"etc/hosts":            "localhost",
+		"src/x/y.go":           "package y",
+		"go/src/fmt/print.go":  "package fmt",
+	} {
+		p := filepath.Join(d, n)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m, err := manifest.Make(os.DirFS(d), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(d, filepath.Dir(manifest.File)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(d, manifest.File), m, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(d, manifest.Sig), manifest.Sign(m, key), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(k string) { manifestKey = k }(manifestKey)
+	manifestKey = base64.StdEncoding.EncodeToString(pub)
+
+	if err := verify(d); err != nil {
+		t.Fatalf("verify: got %v, want nil", err)
+	}
+	// Sources are left to installcommand.
+	if err := os.WriteFile(filepath.Join(d, "src/x/y.go"), []byte("package pwned"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := verify(d); err != nil {
+		t.Errorf("verify with a changed source: got %v, want nil", err)
+	}
+	if err := os.WriteFile(filepath.Join(d, "etc/hosts"), []byte("pwned"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = verify(d)
+	if err == nil {
+		t.Fatalf("verify with a changed etc/hosts: got nil, want error")
+	}
+	if e := enforce(err, manifest.Enforce); e != err {
+		t.Errorf("enforce(%v, enforce): got %v, want the error", err, e)
+	}
+	if e := enforce(err, manifest.Warn); e != nil {
+		t.Errorf("enforce(%v, warn): got %v, want nil", err, e)
+	}
+	if e := enforce(nil, manifest.Enforce); e != nil {
+		t.Errorf("enforce(nil, enforce): got %v, want nil", e)
+	}
+}
@@ -127,6 +127,15 @@ func run(n string, form form) {
 	os.Exit(0)
 }
 
+// goCmd returns a go command with args, run in dir.
+func goCmd(dir string, args ...string) *exec.Cmd {
+	c := exec.Command(fmt.Sprintf("/%s_%s/bin/go", runtime.GOOS, runtime.GOARCH), args...)
+	c.Dir = dir
+	c.Env = os.Environ()
+	c.Env = append(c.Env, []string{"GOCACHE=/.cache", "CGO_ENABLED=0", "GOROOT=/go", "GOPATH=/src"}...)
+	return c
+}
+
 // The kernel will give is this:
 // ["/linux_amd64/bin/installcommand" "#!/src/github.com/u-root/u-root/cmds/core/date" "/linux_amd64/bin/date"]
 // args[0] tells us we were invoked as the installcommand.
@@ -164,12 +173,11 @@ func main() {
 		run(destFile, form)
 	}
 
+	checkSources(form.srcPath)
+
 	v("Build %q install into %q", form.srcPath, destFile)
-	c := exec.Command(fmt.Sprintf("/%s_%s/bin/go", runtime.GOOS, runtime.GOARCH), "build", "-v", "-x", "-o", destFile)
-	c.Dir = form.srcPath
+	c := goCmd(form.srcPath, "build", "-v", "-x", "-o", destFile)
 	c.Stdout, c.Stderr = os.Stdout, os.Stderr
-	c.Env = os.Environ()
-	c.Env = append(c.Env, []string{"GOCACHE=/.cache", "CGO_ENABLED=0", "GOROOT=/go", "GOPATH=/src"}...)
 	v("Args %q env %q", c.Args, c.Env)
 	if err := c.Run(); err != nil {
 		log.Fatal(err)
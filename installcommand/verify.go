@@ -0,0 +1,98 @@
+// Copyright 2022 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/u-root/sourcery/manifest"
+)
+
+// manifestKey is the base64 ed25519 key the image's manifest is signed
+// with, set by the builder with -ldflags -X. If it is empty, sources
+// are not checked.
+var manifestKey string
+
+// sources returns the source files of the package in dir and all its
+// dependencies, relative to /.
+func sources(dir string) ([]string, error) {
+	c := goCmd(dir, "list", "-deps", "-json")
+	var out bytes.Buffer
+	c.Stdout = &out
+	if err := c.Run(); err != nil {
+		return nil, fmt.Errorf("go list: %v", err)
+	}
+	var files []string
+	for d := json.NewDecoder(&out); ; {
+		var p struct {
+			Dir                                 string
+			GoFiles, SFiles, HFiles, EmbedFiles []string
+			Module                              *struct{ GoMod string }
+		}
+		if err := d.Decode(&p); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("go list: %v", err)
+		}
+		for _, l := range [][]string{p.GoFiles, p.SFiles, p.HFiles, p.EmbedFiles} {
+			for _, f := range l {
+				files = append(files, filepath.Join(p.Dir, f))
+			}
+		}
+		if p.Module != nil && p.Module.GoMod != "" {
+			files = append(files, p.Module.GoMod)
+		}
+	}
+	for i := range files {
+		files[i] = strings.TrimPrefix(files[i], "/")
+	}
+	return files, nil
+}
+
+// checkSources checks the sources of the command in dir against the
+// image's manifest and, by the source policy, stops or warns if they
+// do not match.
+func checkSources(dir string) {
+	if manifestKey == "" {
+		v("No manifest key, not checking sources")
+		return
+	}
+	err := func() error {
+		key, err := manifest.ParseKey(manifestKey)
+		if err != nil {
+			return err
+		}
+		m, err := manifest.Read("/", key)
+		if err != nil {
+			return err
+		}
+		files, err := sources(dir)
+		if err != nil {
+			return err
+		}
+		v("Checking %d source files", len(files))
+		if bad := m.Check("/", files...); len(bad) > 0 {
+			n := len(bad)
+			if n > 10 {
+				bad = append(bad[:10], "...")
+			}
+			return fmt.Errorf("%d source files do not match the manifest: %q", n, bad)
+		}
+		return nil
+	}()
+	switch {
+	case err == nil:
+	case manifest.SourcePolicy("/") == manifest.Warn:
+		log.Printf("WARNING: %q may have been tampered with: %v", dir, err)
+	default:
+		log.Fatalf("%q may have been tampered with, not building it: %v", dir, err)
+	}
+}
@@ -8,201 +8,91 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"io/fs"
-	"io/ioutil"
 	"log"
-	"net"
 	"os"
-	"os/exec"
-	"path/filepath"
+	"os/signal"
 	"runtime"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/hashicorp/go-multierror"
-	"github.com/u-root/u-root/pkg/cpio"
-	url "github.com/whilp/git-urls"
+	"github.com/u-root/sourcery/builder"
 )
 
 var (
 	version     = "go1.17.7"
-	V           = log.Printf
 	arch        = runtime.GOARCH
 	kern        = runtime.GOOS
-	bin         string
-	testrun     = true
-	dest        = flag.String("d", "", "Destination directory -- default is os.MkdirTemp")
+	dest        = flag.String("d", "", "Workspace directory -- default is os.MkdirTemp")
 	development = flag.Bool("D", true, "Use development (i.e.) pwd version of installcommand/init, not github version")
 	outCPIO     = flag.String("cpio", "", "output cpio")
+	baseCPIO    = flag.String("base", "", "base cpio, possibly compressed, to merge the tree on top of; its /init becomes /inito")
+	conflict    = flag.String("conflict", "sourcery", "who wins when the base and the tree both have a file: sourcery, base, or error")
+	compress    = flag.String("compress", "", "compression for the cpio: none, gzip or xz; default none, or gzip with -early")
+	outVFAT     = flag.String("vfat", "", "output FAT32 disk image, ready to dd onto a USB stick")
+	vfatSize    = flag.Int64("vfatsize", 0, "size of the FAT32 image in MiB; default is to fit the tree")
+	vfatPart    = flag.String("vfatpart", "mbr", "partition table for the FAT32 image: none, mbr or gpt")
+	bootRootDev = flag.String("root", "", "root= for boot configurations; default is the PARTUUID of the -vfat image, or /dev/sda1")
+	cmdline     = flag.String("cmdline", "", "extra kernel command line for boot configurations")
+	outISO      = flag.String("iso", "", "output ISO 9660 image, with Rock Ridge")
+	isoBIOS     = flag.String("isobios", "", "path in the tree of a no emulation El Torito boot image, e.g. boot/isolinux/isolinux.bin")
+	isoEFI      = flag.String("isoefi", "", "path in the tree of a FAT image for El Torito EFI boot")
+	isoMBR      = flag.String("isombr", "", "file with MBR boot code for the ISO image, e.g. isohdpfx.bin")
+	outOCI      = flag.String("oci", "", "output OCI image layout directory, for podman and docker")
+	ociLayers   = flag.Bool("ocisplit", false, "split the OCI image into toolchain, sources and bin layers")
+	sbom        = flag.String("sbom", "", "directory to write an SPDX SBOM and license files to; they go in the image, too")
+	signKey     = flag.String("sign", "", "PEM ed25519 private key to sign a manifest of the image with, checked by init at boot")
+	verify      = flag.String("verify", "enforce", "what init does if the image does not match its manifest: enforce or warn")
+	srcPolicy   = flag.String("sourcepolicy", "enforce", "what installcommand does if a command's sources do not match the manifest: enforce or warn")
+	sysroot     = flag.String("sysroot", "", "root filesystem for the target to find the shared libraries of dynamically linked -files in, for targets other than the host")
+	kmodDir     = flag.String("kmoddir", "", "kernel modules directory, e.g. /lib/modules/6.1.0-13-amd64, to install -kmod and -hardware modules from")
+	hardware    = flag.String("hardware", "", "file of modaliases, one per line, e.g. from /sys/bus/*/devices/*/modalias, to install kernel modules for")
+	firmware    = flag.String("firmware", "", "firmware directory, e.g. /lib/firmware, to copy the firmware the kernel modules name from")
+	prebuild    = flag.String("prebuild", "", "comma-separated commands to compile into the image at build time, e.g. elvish,ls,cat, rather than on first use")
+	goproxy     = flag.String("goproxy", os.Getenv("GOPROXY"), "GOPROXY to download -module commands through, e.g. file:///srv/goproxy for offline builds")
+	outTree     = flag.String("tree", "", "output tree directory; default is the workspace, if there are no other outputs")
+	plan        = flag.Bool("n", false, "print the plan for the build, without doing it")
+	planJSON    = flag.Bool("json", false, "with -n, print the plan as JSON")
+	reportFile  = flag.String("report", "", "write a JSON build report, with timings and sizes for each phase and repo, to this file")
+	resume      = flag.Bool("resume", false, "resume the last build in -d from the first phase that did not finish")
+	earlyFiles  listFlag
+	kernels     listFlag
+	efiBoot     listFlag
+	hooks       listFlag
+	patches     listFlag
+	overlays    listFlag
+	files       listFlag
+	kmods       listFlag
+	rewrites    listFlag
+	modules     listFlag
 )
 
-// Little note here: you'll see we use go/bin/go a lot, instead of kern_arch/bin/go.
-// Lessons learned the hard way: go/bin/go seems to do a better job of finding
-// GOROOT and other things when run from go/bin. We have not confirmed this from code,
-// but from running it: best to run go/bin/go when doing this build.
-// Will it work for replication? Remains to be seen.
+// listFlag is a flag that can be given more than once.
+type listFlag []string
 
-func clone(tmp, version, repo, dir, base string) error {
-	V("clone: %q, %q, %q, %q", tmp, version, dir, base)
-	dest := filepath.Join(tmp, dir)
-	if err := os.MkdirAll(dest, 0755); err != nil {
-		return err
-	}
-	cmd := []string{"clone", "--depth", "1"}
-	if len(version) > 0 {
-		cmd = append(cmd, "-b", version)
-	}
-	cmd = append(cmd, repo)
-	c := exec.Command("git", cmd...)
-	c.Dir = dest
-	c.Stdout, c.Stderr = os.Stdout, os.Stderr
-	if err := c.Run(); err != nil {
-		return err
-	}
-	return nil
-}
-
-func tidy(tmp, dir, base string) error {
-	c := exec.Command(filepath.Join(tmp, "go/bin/go"), "mod", "tidy")
-	c.Stdout, c.Stderr = os.Stdout, os.Stderr
-	c.Env = append(c.Env, "GOPATH="+tmp)
-	c.Env = append(c.Env, "GOARCH="+arch, "GOOS="+kern, "GOROOT_FINAL=/go", "CGO_ENABLED=0")
-	if a, ok := os.LookupEnv("GOARM"); ok {
-		c.Env = append(c.Env, a)
-	}
-	c.Dir = filepath.Join(tmp, dir, base)
-	V("Run %v(%q, %q in %q)", c, c.Args, c.Env, c.Dir)
-	if err := c.Run(); err != nil {
-		return err
-	}
-	return nil
-}
-
-func modinit(tmp, host, dir, base string) error {
-	path := filepath.Join(tmp, dir, base)
-	V("modinit: check %q for go.mod", path)
-	if _, err := os.Stat(filepath.Join(path, "go.mod")); err == nil {
-		V("modinit: it has go.mod")
-		return nil
-	}
-	c := exec.Command(filepath.Join(tmp, "go/bin/go"), "mod", "init", filepath.Join(host, dir, base))
-	c.Stdout, c.Stderr = os.Stdout, os.Stderr
-	c.Env = append(c.Env, "GOPATH="+tmp)
-	c.Dir = path
-	V("Run %v(%q, %q in %q)", c, c.Args, c.Env, c.Dir)
-	if err := c.Run(); err != nil {
-		return err
-	}
-	return nil
-}
-
-func getgo(d, v string) error {
-	c := exec.Command("git", "clone", "-b", version, "--depth", "1", "git@github.com:golang/go")
-	c.Dir = d
-	c.Stdout, c.Stderr = os.Stdout, os.Stderr
-	if err := c.Run(); err != nil {
-		return err
-	}
-	// simply sanity check
-	gover := filepath.Join(d, "go", "VERSION")
-	dat, err := ioutil.ReadFile(gover)
-	if err != nil {
-		return fmt.Errorf("Reading %q: %v", gover, err)
-	}
-	if string(dat) != version {
-		return fmt.Errorf("Version file has %q, but want version %q", string(dat), version)
-	}
-	return nil
-}
-
-// build builds the code found in filepath.Join(tmp, dir)
-// into bin.
-func build(tmp, sourcePath, dir, bin string, extra ...string) error {
-	c := exec.Command(filepath.Join(tmp, "go/bin/go"), "build", "-o", bin)
-	c.Args = append(c.Args, extra...)
-	c.Dir = filepath.Join(sourcePath, dir)
-	c.Stdout, c.Stderr = os.Stdout, os.Stderr
-	c.Env = os.Environ()
-	c.Env = append(c.Env, "GOROOT_FINAL=/go", "CGO_ENABLED=0")
-	if err := c.Run(); err != nil {
-		return err
-	}
-	return nil
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
 }
 
-// buildToolchain builds the needed Go toolchain binaries: go, compile, link,
-// asm. We can no longer do this without the script. Damn.
-// TODO: figure out what files we can remove.
-func buildToolchain(tmp string) error {
-	c := exec.Command("bash", "make.bash")
-	c.Dir = filepath.Join(tmp, "go/src")
-	c.Stdout, c.Stderr = os.Stdout, os.Stderr
-	c.Env = os.Environ()
-	c.Env = append(c.Env, "GOROOT_FINAL=/go", "CGO_ENABLED=0")
-	if err := c.Run(); err != nil {
-		return err
-	}
-	// Need to also build the go command itself.
-	c = exec.Command(filepath.Join(tmp, "go/bin/go"), "build", "-o", filepath.Join(tmp, bin, "go"))
-	c.Dir = filepath.Join(tmp, "go/src/cmd/go")
-	c.Stdout, c.Stderr = os.Stdout, os.Stderr
-	c.Env = os.Environ()
-	c.Env = append(c.Env, "GOARCH="+arch, "GOOS="+kern, "GOROOT_FINAL=/go", "CGO_ENABLED=0")
-	if a, ok := os.LookupEnv("GOARM"); ok {
-		c.Env = append(c.Env, a)
-	}
-	V("Build go toolchain, Args %v, Env %v", c.Args, c.Env)
-	if err := c.Run(); err != nil {
-		return err
-	}
+func (l *listFlag) Set(s string) error {
+	*l = append(*l, s)
 	return nil
 }
 
-func goName(p string) (string, string, string, error) {
-	u, err := url.ParseScp(p)
-	if err != nil {
-		return "", "", "", err
-	}
-	// The `Host` contains both the hostname and the port,
-	// if present. Use `SplitHostPort` to extract them.
-	fmt.Println(u.Host)
-	host, _, err := net.SplitHostPort(u.Host)
-	if err != nil {
-		host = u.Host
-	}
-	return host, filepath.Dir(u.Path), filepath.Base(u.Path), nil
-}
-
-func get(target string, args ...string) error {
-	var err error
-	for _, d := range args {
-		V("Get %q", d)
-		host, dir, base, err := goName(d)
-		if err != nil {
-			V("URL %q: %v", d, err)
-			err = multierror.Append(err, fmt.Errorf("%q: %v", d, err))
-			continue
-		}
-		dir = filepath.Join(host, dir)
-		V("goName for %q: %q, %q, %q", d, host, dir, base)
-		if e := clone(target, "", d, dir, base); err != nil {
-			err = multierror.Append(err, e)
-			continue
-		}
-
-		if e := modinit(target, host, dir, base); e != nil {
-			err = multierror.Append(err, e)
-			continue
-		}
-		if e := tidy(target, dir, base); e != nil {
-			err = multierror.Append(err, e)
-			continue
-		}
-	}
-	return err
-}
-
 func init() {
+	flag.Var(&kernels, "kernel", "arch=path of a kernel to boot arch from the stick, e.g. arm64=Image; may be repeated")
+	flag.Var(&efiBoot, "efiboot", "arch=path of an EFI boot manager that reads loader/entries, e.g. systemd-bootx64.efi, to boot arch's kernel with; may be repeated")
+	flag.Var(&hooks, "hook", "point=command to run at a point in the build, e.g. post-fetch=./patch.sh; the command is split at spaces; may be repeated")
+	flag.Var(&overlays, "overlay", "dir[:dest] directory to copy into the tree at dest, default /; may be repeated")
+	flag.Var(&files, "files", "host[:dest] file or directory to copy into the tree at dest, default its host path, with the shared libraries of dynamically linked binaries; may be repeated")
+	flag.Var(&kmods, "kmod", "name of a kernel module to install from -kmoddir, with those it depends on; may be repeated")
+	flag.Var(&modules, "module", "path@version of a command to download through $GOPROXY, e.g. golang.org/x/tools/cmd/stringer@v0.1.12; may be repeated")
+	flag.Var(&rewrites, "rewrite", "from=to rule to fetch URLs starting with from from to instead, like git's insteadOf; may be repeated, and added to by $SOURCERY_REWRITE")
+	flag.Var(&patches, "patch", "repo=path of a patch, or directory of .patch and .diff files, to apply to repo when it is fetched; may be repeated")
+	flag.Var(&earlyFiles, "early", "host[:dest] file or directory for the uncompressed early cpio, e.g. /lib/firmware/intel-ucode; may be repeated")
 	if a, ok := os.LookupEnv("GOARCH"); ok {
 		arch = a
 	}
@@ -211,169 +101,156 @@ func init() {
 	}
 }
 
-func tree(d string) error {
-	var err error
-	for _, n := range []string{"tmp", "dev", "etc"} {
-		if e := os.MkdirAll(filepath.Join(d, n), 0755); e != nil {
-			err = multierror.Append(err, e)
-		}
-	}
-	return err
-}
-
-func files(tmp, binpath, destdir string) error {
-	var err error
-	if err = os.MkdirAll(destdir, 0755); err != nil {
-		return err
-	}
-	include := filepath.Join(tmp, "go/pkg/include")
-	if err = os.MkdirAll(include, 0755); err != nil {
-		return err
+func main() {
+	// sourcery verify-repro [flags] repos... builds twice and compares.
+	repro := len(os.Args) > 1 && os.Args[1] == "verify-repro"
+	if repro {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
 	}
+	flag.Parse()
 
-	// There are certain common patterns we know are commands.
-	// Just Do It.
-	var dirs []string
-	for _, g := range []string{
-		"/src/github.com/u-root/u-root/cmds/*/*",
-		"/src/github.com/u-root/NiChrome/cmds/*",
-		"/src/github.com/u-root/cpu/cmds/*",
-		"/src/github.com/nsf/godit",
-	} {
-		m, err := filepath.Glob(filepath.Join(tmp, g))
+	o := builder.Options{
+		Version:      version,
+		OS:           kern,
+		Arch:         arch,
+		Workspace:    *dest,
+		Repos:        flag.Args(),
+		Resume:       *resume,
+		Report:       *reportFile,
+		CPIO:         *outCPIO,
+		Base:         *baseCPIO,
+		Conflict:     *conflict,
+		Compress:     *compress,
+		Early:        earlyFiles,
+		VFAT:         *outVFAT,
+		VFATSize:     *vfatSize << 20,
+		VFATPart:     *vfatPart,
+		Kernels:      kernels,
+		EFIBoot:      efiBoot,
+		Root:         *bootRootDev,
+		Cmdline:      *cmdline,
+		ISO:          *outISO,
+		ISOBIOS:      *isoBIOS,
+		ISOEFI:       *isoEFI,
+		ISOMBR:       *isoMBR,
+		OCI:          *outOCI,
+		OCISplit:     *ociLayers,
+		SBOM:         *sbom,
+		SignKey:      *signKey,
+		VerifyPolicy: *verify,
+		SourcePolicy: *srcPolicy,
+		Tree:         *outTree,
+		Overlays:     overlays,
+		Files:        files,
+		Sysroot:      *sysroot,
+		Modules:      modules,
+		Prebuild:     prebuildList(*prebuild),
+		GOPROXY:      *goproxy,
+		// Rules from the environment, then the command line.
+		Rewrites: append(strings.Fields(os.Getenv("SOURCERY_REWRITE")), rewrites...),
+		// Kernel modules, and their firmware, for this target.
+		KernelModules: *kmodDir,
+		KModules:      kmods,
+		Hardware:      *hardware,
+		Firmware:      *firmware,
+	}
+	if s, ok := os.LookupEnv("SOURCE_DATE_EPOCH"); ok {
+		n, err := strconv.ParseInt(s, 10, 64)
 		if err != nil {
-			V("%q: %v", g, err)
-			continue
+			log.Fatalf("SOURCE_DATE_EPOCH %q: want seconds since 1970", s)
 		}
-		dirs = append(dirs, m...)
+		o.SourceDateEpoch = time.Unix(n, 0)
 	}
-	for _, n := range dirs {
-		r, e := filepath.Rel(tmp, n)
-		if e != nil {
-			err = multierror.Append(err, e)
-		}
-		f := filepath.Join(destdir, filepath.Base(n))
-		dat := []byte("#!/" + binpath + "/installcommand #!/" + r + "\n")
-		V("Write %q with %q", f, dat)
-		if e := ioutil.WriteFile(f, dat, 0755); e != nil {
-			err = multierror.Append(err, e)
+	for _, h := range hooks {
+		p, c, ok := strings.Cut(h, "=")
+		if !ok {
+			log.Fatalf("hook %q: want point=command", h)
 		}
+		o.Hooks = append(o.Hooks, builder.Hook{Point: p, Command: c})
 	}
-
-	return err
-}
-
-func ramfs(from, out string, filter ...string) error {
-	to, err := os.Create(out)
-	if err != nil {
-		return err
-	}
-	log.Printf("Archiving to %v", out)
-	archiver, err := cpio.Format("newc")
-	if err != nil {
-		log.Fatalf("Format %q not supported: %v", "newc", err)
-	}
-
-	rw := archiver.Writer(to)
-	cr := cpio.NewRecorder()
-
-	if err := filepath.WalkDir(from, func(name string, _ fs.DirEntry, err error) error {
-		if err != nil {
-			return err
+	for _, p := range patches {
+		r, f, ok := strings.Cut(p, "=")
+		if !ok {
+			log.Fatalf("patch %q: want repo=path", p)
 		}
-		n, err := filepath.Rel(from, name)
-		if err != nil {
-			return err
+		if o.Patches == nil {
+			o.Patches = map[string][]string{}
 		}
-		V("Archive %q", name)
-		rec, err := cr.GetRecord(name)
-		rec.Name = n
+		o.Patches[r] = append(o.Patches[r], f)
+	}
+	if *development {
+		pwd, err := os.Getwd()
 		if err != nil {
-			return fmt.Errorf("Getting record of %q failed: %v", name, err)
-		}
-		if err := rw.WriteRecord(rec); err != nil {
-			log.Fatalf("Writing record %q failed: %v", name, err)
+			log.Fatal(err)
 		}
-		return nil
-	}); err != nil {
-		return err
+		o.ToolSource = pwd
 	}
-	if err := cpio.WriteTrailer(rw); err != nil {
-		return fmt.Errorf("Error writing trailer record: %v", err)
+	if repro {
+		verifyRepro(o)
+		return
 	}
-	return nil
-}
-
-func main() {
-	flag.Parse()
-	V("Building for %v_%v", arch, kern)
-
-	// Build the target directory
-	// Start with a temporary directory
-	// copy the toolchain there
-	// copy the rest of the other directories there
-	pwd, err := os.Getwd()
+	b, err := builder.New(o)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	d := *dest
-	if len(*dest) == 0 {
-		var err error
-		d, err = os.MkdirTemp("", "sourcery")
+	if *plan {
+		p, err := b.Plan()
 		if err != nil {
 			log.Fatal(err)
 		}
-
-	}
-	defer fmt.Printf("Tree is %q\n", d)
-	if err != nil {
-		log.Fatal(err)
-	}
-	if err := tree(d); err != nil {
-		log.Fatal(err)
-	}
-	bin = filepath.Join(fmt.Sprintf("%v_%v", kern, arch), "bin")
-	if err := os.MkdirAll(filepath.Join(d, bin), 0755); err != nil {
-		log.Fatal(err)
+		if err := p.Print(os.Stdout, *planJSON); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
-	if err := getgo(d, version); err != nil {
-		log.Printf("getgo errored, %v, keep going", err)
-	}
-	if err := buildToolchain(d); err != nil {
-		log.Fatal(err)
-	}
-	if err := os.MkdirAll(filepath.Join(d, "src"), 0755); err != nil {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	if err := b.Build(ctx); err != nil {
 		log.Fatal(err)
 	}
-	if err := get(filepath.Join(d, "src"), append(flag.Args(), "git@github.com:u-root/sourcery")...); err != nil {
-		log.Fatalf("Getting packages: %v", err)
-	}
-
-	if err := files(d, bin, filepath.Join(d, bin)); err != nil {
-		log.Fatal(err)
+	fmt.Printf("Workspace is %q\n", b.Workspace)
+	if b.Chroot == "" {
+		return
 	}
+	log.Printf("sudo strace -o syscalltrace -f %s", b.Chroot)
+	log.Printf("%s", b.Chroot)
+	log.Printf("rsync -avz --no-owner --no-group -I %q somewhere", b.TreeDir())
+}
 
-	baseToolPath := filepath.Join(d, bin)
-	if *development {
-		baseToolPath = pwd
-	}
-	V("Build tools from %q", baseToolPath)
-	for _, tool := range []string{"installcommand", "init"} {
-		goBin := filepath.Join(d, bin, tool)
-		V("Build %q in %q, install to %q", tool, baseToolPath, goBin)
-		if err := build(d, baseToolPath, tool, goBin); err != nil {
-			log.Fatalf("Building %q -> %q: %v", goBin, tool, err)
+// prebuildList splits a comma-separated -prebuild list.
+func prebuildList(s string) []string {
+	var l []string
+	for _, n := range strings.Split(s, ",") {
+		if n = strings.TrimSpace(n); n != "" {
+			l = append(l, n)
 		}
 	}
+	return l
+}
 
-	if *outCPIO != "" {
-		if err := ramfs(d, *outCPIO); err != nil {
-			log.Printf("ramfs: %v", err)
+// verifyRepro builds o twice, in -d or a temporary directory, and exits
+// non-zero if the builds differ.
+func verifyRepro(o builder.Options) {
+	d := o.Workspace
+	if d == "" {
+		var err error
+		if d, err = os.MkdirTemp("", "sourcery-repro"); err != nil {
+			log.Fatal(err)
 		}
 	}
-	log.Printf("sudo strace -o syscalltrace -f unshare -m chroot %q /%q_%q/bin/init", d, kern, arch)
-	log.Printf("unshare -m chroot %q /%q_%q/bin/init", d, kern, arch)
-	log.Printf("rsync -avz --no-owner --no-group -I %q somewhere", d)
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	diffs, err := builder.Repro(ctx, o, d)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, l := range diffs {
+		fmt.Println(l)
+	}
+	if len(diffs) > 0 {
+		log.Fatalf("The builds in %q differ in %d places: not reproducible", d, len(diffs))
+	}
+	log.Printf("The builds in %q are the same", d)
 }
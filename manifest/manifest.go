@@ -0,0 +1,184 @@
+// Copyright 2022 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package manifest makes and checks the signed list of file hashes
+// sourcery puts in an image, so that init can tell at boot, and
+// installcommand before it compiles a command, if a stick has been
+// tampered with.
+//
+// A manifest is in the format of sha256sum: a line for each regular
+// file, its hex SHA-256, two spaces and its path, sorted by path. The
+// signature is the base64 ed25519 signature of the manifest.
+package manifest
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// File is where the manifest is in the image.
+	File = "etc/sourcery/manifest"
+	// Sig is where its signature is.
+	Sig = File + ".sig"
+	// SourcePolicyFile holds the policy for installcommand to check
+	// sources with. It may be changed at run time.
+	SourcePolicyFile = "etc/sourcery/source-policy"
+)
+
+// Policies say what to do when files do not match the manifest.
+const (
+	// Enforce refuses to go on.
+	Enforce = "enforce"
+	// Warn says so and goes on.
+	Warn = "warn"
+)
+
+// CheckPolicy returns an error if p is not a policy.
+func CheckPolicy(p string) error {
+	if p != Enforce && p != Warn {
+		return fmt.Errorf("policy %q: want %q or %q", p, Enforce, Warn)
+	}
+	return nil
+}
+
+// SourcePolicy returns the source policy of the image at root,
+// Enforce if it has none.
+func SourcePolicy(root string) string {
+	dat, err := os.ReadFile(filepath.Join(root, SourcePolicyFile))
+	if err != nil {
+		return Enforce
+	}
+	return strings.TrimSpace(string(dat))
+}
+
+// hash returns the hex SHA-256 of r.
+func hash(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Make returns the manifest of the regular files in fsys, leaving out
+// the manifest and its signature, .git directories, which nothing
+// builds from, and the files skip, if not nil, returns true for.
+func Make(fsys fs.FS, skip func(name string) bool) ([]byte, error) {
+	var b bytes.Buffer
+	err := fs.WalkDir(fsys, ".", func(n string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && d.Name() == ".git" {
+			return fs.SkipDir
+		}
+		if !d.Type().IsRegular() || n == File || n == Sig || (skip != nil && skip(n)) {
+			return nil
+		}
+		f, err := fsys.Open(n)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		h, err := hash(f)
+		if err != nil {
+			return fmt.Errorf("%q: %v", n, err)
+		}
+		fmt.Fprintf(&b, "%s  %s\n", h, n)
+		return nil
+	})
+	return b.Bytes(), err
+}
+
+// Sign returns the signature of manifest m by key.
+func Sign(m []byte, key ed25519.PrivateKey) []byte {
+	return []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(key, m)) + "\n")
+}
+
+// ParseKey returns the public key in base64 string k.
+func ParseKey(k string) (ed25519.PublicKey, error) {
+	dat, err := base64.StdEncoding.DecodeString(k)
+	if err != nil || len(dat) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("%q is not a base64 ed25519 public key", k)
+	}
+	return ed25519.PublicKey(dat), nil
+}
+
+// A Manifest maps paths to hex SHA-256 hashes.
+type Manifest map[string]string
+
+// Read reads the manifest and signature in the image at root, checks
+// the signature against key, and returns the manifest.
+func Read(root string, key ed25519.PublicKey) (Manifest, error) {
+	m, err := os.ReadFile(filepath.Join(root, File))
+	if err != nil {
+		return nil, err
+	}
+	sig, err := os.ReadFile(filepath.Join(root, Sig))
+	if err != nil {
+		return nil, err
+	}
+	s, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+	if err != nil || !ed25519.Verify(key, m, s) {
+		return nil, fmt.Errorf("%s: bad signature", File)
+	}
+	return Parse(m)
+}
+
+// Parse parses manifest m.
+func Parse(m []byte) (Manifest, error) {
+	man := Manifest{}
+	s := bufio.NewScanner(bytes.NewReader(m))
+	for l := 1; s.Scan(); l++ {
+		h, n, ok := strings.Cut(s.Text(), "  ")
+		if !ok || len(h) != 2*sha256.Size {
+			return nil, fmt.Errorf("%s:%d: not hash  path", File, l)
+		}
+		man[n] = h
+	}
+	return man, s.Err()
+}
+
+// Check hashes the files named in the image at root and returns the
+// ones that do not match m: changed, missing, or not in m at all.
+// With no names, it checks all of m.
+func (m Manifest) Check(root string, names ...string) []string {
+	if len(names) == 0 {
+		for n := range m {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+	var bad []string
+	for _, n := range names {
+		want, ok := m[n]
+		if !ok {
+			bad = append(bad, n)
+			continue
+		}
+		f, err := os.Open(filepath.Join(root, n))
+		if err != nil {
+			bad = append(bad, n)
+			continue
+		}
+		got, err := hash(f)
+		f.Close()
+		if err != nil || got != want {
+			bad = append(bad, n)
+		}
+	}
+	return bad
+}
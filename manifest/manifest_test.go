@@ -0,0 +1,90 @@
+// Copyright 2022 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package manifest
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+func TestManifest(t *testing.T) {
+	fsys := fstest.MapFS{
+		"bin/init":   {Data: []byte("init")},
+		"etc/hosts":  {Data: []byte("localhost")},
+		"etc/motd":   {Data: []byte("hi")},
+		File:         {Data: []byte("old manifest")},
+		"dev/null":   {Mode: os.ModeDevice},
+		"bin/ls":     {Data: []byte("ls")},
+		"lib/x.so.1": {Data: []byte("lib")},
+		"src/.git/x": {Data: []byte("git")},
+		"boot/linux": {Data: []byte("kernel")},
+	}
+	m, err := Make(fsys, func(n string) bool { return n == "boot/linux" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := t.TempDir()
+	for n, f := range fsys {
+		if !f.Mode.IsRegular() {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(d, n)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(d, n), f.Data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(d, File), m, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(d, Sig), Sign(m, key), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	k, err := ParseKey(base64.StdEncoding.EncodeToString(pub))
+	if err != nil {
+		t.Fatal(err)
+	}
+	man, err := Read(d, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(man) != 5 {
+		t.Errorf("manifest: got %q, want the 5 regular files", man)
+	}
+	if bad := man.Check(d); bad != nil {
+		t.Errorf("Check: got %q, want nil", bad)
+	}
+	if err := os.WriteFile(filepath.Join(d, "etc/motd"), []byte("pwned"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(d, "bin/ls")); err != nil {
+		t.Fatal(err)
+	}
+	if bad, want := man.Check(d), []string{"bin/ls", "etc/motd"}; !reflect.DeepEqual(bad, want) {
+		t.Errorf("Check: got %q, want %q", bad, want)
+	}
+	if bad, want := man.Check(d, "bin/init", "etc/new"), []string{"etc/new"}; !reflect.DeepEqual(bad, want) {
+		t.Errorf("Check(bin/init, etc/new): got %q, want %q", bad, want)
+	}
+
+	other, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Read(d, other); err == nil {
+		t.Errorf("Read with another key: got nil, want error")
+	}
+}